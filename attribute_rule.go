@@ -0,0 +1,149 @@
+package cfs
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// AttributeRule は、パスにマッチしたファイルの圧縮や暗号化の設定を表す
+// OptionInfo.AttributeRules に並べたルールのうち、最初にマッチしたものが使われる
+type AttributeRule struct {
+	Pattern  string // globパターン、"/"を含まない場合はファイル名に、含む場合はパス全体にマッチする("**"も使える)
+	Regexp   string // パス全体にマッチする正規表現(Patternの代わりに指定する)
+	Compress *bool  // 圧縮するかどうか(nilなら設定に従う)
+	Encrypt  *bool  // 暗号化するかどうか(nilなら設定に従う)
+	Codec    string // 圧縮の方式(空なら設定に従う)
+
+	re *regexp.Regexp
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// defaultAttributeRules は、設定がない場合のルール
+// アセットバンドルや動画などの、すでに圧縮されているファイルは圧縮も暗号化もしない
+func defaultAttributeRules() []AttributeRule {
+	rules := []AttributeRule{}
+	for _, ext := range []string{".ab", ".raw", ".pbx", ".mp4"} {
+		rules = append(rules, AttributeRule{Pattern: "*" + ext, Compress: boolPtr(false), Encrypt: boolPtr(false)})
+	}
+	return rules
+}
+
+func (r *AttributeRule) compile() error {
+	if r.re != nil {
+		return nil
+	}
+
+	var err error
+	switch {
+	case r.Regexp != "":
+		r.re, err = regexp.Compile(r.Regexp)
+	case r.Pattern != "":
+		r.re, err = regexp.Compile(globToRegexp(r.Pattern))
+	default:
+		return fmt.Errorf("attribute rule must have Pattern or Regexp")
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.Codec != "" {
+		_, err = ParseCodec(r.Codec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match は、ルールがpathにマッチするかどうかを返す
+func (r *AttributeRule) Match(filePath string) bool {
+	if r.compile() != nil {
+		return false
+	}
+	if r.Regexp == "" && !strings.Contains(r.Pattern, "/") {
+		return r.re.MatchString(path.Base(filePath))
+	}
+	return r.re.MatchString(filePath)
+}
+
+// String は、ルールを表示用の文字列にする
+func (r *AttributeRule) String() string {
+	s := "pattern " + r.Pattern
+	if r.Regexp != "" {
+		s = "regexp " + r.Regexp
+	}
+	if r.Compress != nil {
+		s += fmt.Sprintf(" compress=%v", *r.Compress)
+	}
+	if r.Codec != "" {
+		s += " codec=" + r.Codec
+	}
+	if r.Encrypt != nil {
+		s += fmt.Sprintf(" encrypt=%v", *r.Encrypt)
+	}
+	return s
+}
+
+// Apply は、attrにルールを適用したContentAttributeを返す
+func (r *AttributeRule) Apply(attr ContentAttribute) ContentAttribute {
+	if r.Compress != nil || r.Codec != "" {
+		attr &^= Compressed | codecMask
+		if r.Compress == nil || *r.Compress {
+			codecName := r.Codec
+			if codecName == "" {
+				codecName = Option.Codec
+			}
+			codec, _ := ParseCodec(codecName)
+			attr = (attr | Compressed).WithCodec(codec)
+		}
+	}
+	if r.Encrypt != nil {
+		attr &^= Crypted | AuthCrypted | KeyTagged
+		if *r.Encrypt {
+			attr |= encryptAttribute()
+		}
+	}
+	return attr
+}
+
+// FindAttributeRule は、pathに最初にマッチするルールの番号とルールを返す
+// マッチするルールがない場合は、-1とnilを返す
+func (o *OptionInfo) FindAttributeRule(path string) (int, *AttributeRule) {
+	for i := range o.AttributeRules {
+		if o.AttributeRules[i].Match(path) {
+			return i, &o.AttributeRules[i]
+		}
+	}
+	return -1, nil
+}
+
+// globToRegexp は、globパターンを正規表現に変換する
+// "**" は"/"を含む任意の文字列に、"*" と "?" は"/"を含まない文字列にマッチする
+func globToRegexp(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
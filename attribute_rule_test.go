@@ -0,0 +1,71 @@
+package cfs
+
+import (
+	"testing"
+)
+
+func TestAttributeRuleMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.png", "hoge.png", true},
+		{"*.png", "dir/hoge.png", true},
+		{"*.png", "hoge.png.txt", false},
+		{"sound/*.ogg", "sound/bgm.ogg", true},
+		{"sound/*.ogg", "sound/se/hit.ogg", false},
+		{"sound/**/*.ogg", "sound/se/hit.ogg", true},
+		{"sound/**/*.ogg", "sound/bgm.ogg", true},
+		{"sound/**", "sound/se/hit.ogg", true},
+		{"sound/**", "voice/hit.ogg", false},
+	}
+	for _, c := range cases {
+		rule := AttributeRule{Pattern: c.pattern}
+		if rule.Match(c.path) != c.match {
+			t.Errorf("pattern %s with %s must be %v", c.pattern, c.path, c.match)
+		}
+	}
+
+	rule := AttributeRule{Regexp: `^movie/.*\.(mp4|webm)$`}
+	if !rule.Match("movie/op.webm") || rule.Match("op.webm") {
+		t.Errorf("invalid regexp match")
+	}
+}
+
+func TestAttributeRules(t *testing.T) {
+	oldOption := *Option
+	defer func() { *Option = oldOption }()
+
+	err := Option.Parse([]byte(`{
+		"Codec": "zlib",
+		"AttributeRules": [
+			{"Pattern": "*.png", "Compress": false},
+			{"Pattern": "text/**", "Codec": "zstd", "Encrypt": false},
+			{"Regexp": "\\.bin$", "Compress": false, "Encrypt": false}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBucket()
+	cases := map[string]ContentAttribute{
+		"hoge.png":        DefaultContentAttribute() &^ Compressed,
+		"text/hoge.txt":   ContentAttribute(Compressed).WithCodec(CodecZstd),
+		"data/hoge.bin":   NoContentAttribute,
+		"hoge.ab":         DefaultContentAttribute(), // 設定した場合は、デフォルトのルールは使われない
+		"other/hoge.json": DefaultContentAttribute(),
+	}
+	for path, expected := range cases {
+		attr := b.GetAttribute(path)
+		if attr != expected {
+			t.Errorf("attribute of %s must be %v but %v", path, expected, attr)
+		}
+	}
+
+	err = Option.Parse([]byte(`{"AttributeRules": [{"Pattern": "*.png", "Codec": "unknown"}]}`))
+	if err == nil {
+		t.Errorf("invalid codec must be error")
+	}
+}
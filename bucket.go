@@ -1,9 +1,11 @@
 package cfs
 
 import (
-	"crypto/md5"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -11,8 +13,9 @@ import (
 	"time"
 )
 
-// ExcludePatterns は除外するファイルのパターンを表す
-var ExcludePatterns = []string{".*", "*.vdat", "cfs", "*.meta", "*.tmx"}
+// ExcludePatterns はアップロード時にデフォルトで除外するファイルのパターンを表す
+// 書式は .gitignore と同じ(see IgnoreMatcher)
+var ExcludePatterns = []string{".*", `\#*`, "*~", "*.meta", "*.manifest", "*.tmx", "*.vdat", "/cfs"}
 
 // Verbose 詳細なログを表示するかどうか
 var Verbose = false
@@ -26,6 +29,12 @@ type Bucket struct {
 	Contents    map[string]Content
 	HashType    string
 	UploadCount int
+
+	// バケットのファイルのヘッダに記録される情報
+	Version  int       // 読み込んだファイルの形式のバージョン(ヘッダがない古い形式なら1)
+	Created  time.Time // 作成した時刻(UploadBucket は記録しない)
+	Uploader string    // 作成したユーザー(UploadBucket は記録しない)
+	Parent   string    // 前のバケットのハッシュ(なければ空)
 }
 
 // ContentAttribute はコンテンツの圧縮や暗号の状態を表すenum
@@ -36,8 +45,14 @@ const (
 	NoContentAttribute ContentAttribute = 0
 	// Compressed は圧縮をするかどうかを示す
 	Compressed = 1
-	// Crypted は暗号化をするかどうかを示す
+	// Crypted は暗号化(AES-CFB)をするかどうかを示す
 	Crypted = 2
+	// AuthCrypted は認証付き暗号化(AES-GCM)をするかどうかを示す
+	AuthCrypted = 4
+	// KeyTagged は暗号化したデータの先頭に鍵IDをつけるかどうかを示す
+	KeyTagged = 8
+	// Chunked はファイルを分割して保存し、ハッシュがチャンクリストを指すことを示す
+	Chunked = 256
 )
 
 // Content は一つのファイルの内容を表すstruct
@@ -45,11 +60,12 @@ type Content struct {
 	Path     string
 	Hash     string
 	Time     time.Time
-	Size     int
+	Size     int // 保存したデータのサイズ(Chunked なら、チャンクリストと全てのチャンクのサイズの合計)
 	OrigHash string
 	OrigSize int
 	Attr     ContentAttribute
-	Touched  bool
+	KeyId    string // 暗号化に使った鍵のID(鍵IDを使っていない場合は空)
+	Touched  bool   `json:"-"`
 }
 
 // DefaultContentAttribute デフォルトのContentAttributeを取得する
@@ -57,35 +73,103 @@ func DefaultContentAttribute() ContentAttribute {
 	var result ContentAttribute
 	if Option.Compress {
 		result |= Compressed
+		// 不正な名前は、 OptionInfo.Parse でエラーになる
+		codec, _ := ParseCodec(Option.Codec)
+		result = result.WithCodec(codec)
 	}
-	if Option.EncryptKey != "" {
-		result |= Crypted
-	}
+	result |= encryptAttribute()
 	return ContentAttribute(result)
 }
 
+// encryptAttribute 設定に従って暗号化する場合のContentAttributeを取得する
+// 鍵が設定されていない場合は暗号化しない
+func encryptAttribute() ContentAttribute {
+	var result ContentAttribute
+	if Option.EncryptKey != "" || Option.EncryptKeyId != "" {
+		if Option.EncryptMode == EncryptModeGCM {
+			result |= AuthCrypted
+		} else {
+			result |= Crypted
+		}
+		if Option.EncryptKeyId != "" {
+			result |= KeyTagged
+		}
+	}
+	return result
+}
+
+// String 属性を表示用の文字列にする
+func (c ContentAttribute) String() string {
+	parts := []string{}
+	if c.Compressed() {
+		parts = append(parts, c.Codec().String())
+	}
+	if c.AuthCrypted() {
+		parts = append(parts, EncryptModeGCM)
+	} else if c.Crypted() {
+		parts = append(parts, EncryptModeCFB)
+	}
+	if c.KeyTagged() {
+		parts = append(parts, "keyid")
+	}
+	if c.Chunked() {
+		parts = append(parts, "chunked")
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, "+")
+}
+
 // Compressed 圧縮するかどうかを返す
 func (c ContentAttribute) Compressed() bool {
 	return (int(c) & Compressed) != 0
 }
 
+// Chunked 分割して保存されているかどうかを返す
+func (c ContentAttribute) Chunked() bool {
+	return (int(c) & Chunked) != 0
+}
+
+// Codec 圧縮の方式を返す
+func (c ContentAttribute) Codec() Codec {
+	return Codec((int(c) & codecMask) >> codecShift)
+}
+
+// WithCodec 圧縮の方式をcodecにしたContentAttributeを返す
+func (c ContentAttribute) WithCodec(codec Codec) ContentAttribute {
+	return ContentAttribute((int(c) &^ codecMask) | (int(codec) << codecShift))
+}
+
+// Crypted AES-CFBで暗号化するかどうかを返す
 func (c ContentAttribute) Crypted() bool {
 	return (int(c) & Crypted) != 0
 }
 
+// AuthCrypted AES-GCMで暗号化するかどうかを返す
+func (c ContentAttribute) AuthCrypted() bool {
+	return (int(c) & AuthCrypted) != 0
+}
+
+// KeyTagged 暗号化したデータに鍵IDをつけるかどうかを返す
+func (c ContentAttribute) KeyTagged() bool {
+	return (int(c) & KeyTagged) != 0
+}
+
+// NewBucket は、空のバケットを作成する
+// ハッシュの種類は Option.HashType になる
 func NewBucket() *Bucket {
 	return &Bucket{
 		Contents: make(map[string]Content),
-		HashType: "md5",
+		HashType: Option.DefaultHashType(),
 	}
 }
 
+// BucketFromFile は、ファイルからバケットを読み込む
+// ファイルが存在しない場合は、空のバケットを返す
 func BucketFromFile(path string) (*Bucket, error) {
-	b := &Bucket{
-		Path:     path,
-		Contents: make(map[string]Content),
-		HashType: "md5",
-	}
+	b := NewBucket()
+	b.Path = path
 	data, err := ioutil.ReadFile(filepath.FromSlash(path))
 	if err == nil {
 		if Verbose {
@@ -100,42 +184,137 @@ func BucketFromFile(path string) (*Bucket, error) {
 
 }
 
+// BucketFormatVersion は、バケットのファイルの形式のバージョン
+// バージョン1は、ヘッダの行がない古い形式
+const BucketFormatVersion = 2
+
+// bucketHeader は、バケットのファイルの先頭のヘッダの行の先頭
+// ヘッダの行はタブを含まないので、古いcfsでは列が足りない行として無視される
+const bucketHeader = "#cfs-bucket"
+
+// legacyHashTypeHeader は、ヘッダの行がある形式より前に、ハッシュの種類を記録していた行の先頭
+const legacyHashTypeHeader = "#hash "
+
+// contentColumns は、コンテンツの行に必要な列の数
+// (hash, path, size, time, orighash, origsize, attr と、省略可能な keyid が続き、それより後の列は無視する)
+const contentColumns = 7
+
+// Parse は、ダンプされたバケットを読み込む
+// ハッシュの種類が記録されていない場合は、md5のバケットとして扱う
+// ヘッダの知らない項目や、コンテンツの行の知らない列は無視する
 func (b *Bucket) Parse(s []byte) error {
-	for _, line := range strings.Split(string(s), "\n") {
-		if len(s) != 0 {
-			col := strings.Split(line, "\t")
-			if len(col) >= 3 {
-				size, err := strconv.Atoi(col[2])
-				if err != nil {
-					return err
-				}
-				time, err := time.Parse(time.RFC3339, col[3])
-				if err != nil {
-					return err
-				}
-				origSize, err := strconv.Atoi(col[5])
-				if err != nil {
-					return err
-				}
-				attr, err := strconv.Atoi(col[6])
-				if err != nil {
-					return err
-				}
-				b.Contents[col[1]] = Content{
-					Hash:     col[0],
-					Path:     col[1],
-					Size:     size,
-					Time:     time,
-					OrigHash: col[4],
-					OrigSize: origSize,
-					Attr:     ContentAttribute(attr),
-				}
+	b.HashType = HashTypeMD5
+	b.Version = 1
+	for i, line := range strings.Split(string(s), "\n") {
+		lineNo := i + 1
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, bucketHeader+" "):
+			err := b.parseHeader(line[len(bucketHeader)+1:])
+			if err != nil {
+				return fmt.Errorf("invalid bucket header at line %d, %v", lineNo, err)
+			}
+			continue
+		case strings.HasPrefix(line, legacyHashTypeHeader):
+			hashType := strings.TrimSpace(line[len(legacyHashTypeHeader):])
+			if _, err := NewHash(hashType); err != nil {
+				return fmt.Errorf("invalid bucket header at line %d, %v", lineNo, err)
 			}
+			b.HashType = hashType
+			continue
+		case strings.HasPrefix(line, "#"):
+			// 新しい形式のためのコメントの行
+			continue
 		}
+
+		c, err := parseContent(line)
+		if err != nil {
+			return fmt.Errorf("invalid bucket at line %d, %v", lineNo, err)
+		}
+		b.Contents[c.Path] = c
 	}
 	return nil
 }
 
+// parseHeader は、ヘッダの行の "key=value" をスペース区切りで並べた部分を読み込む
+func (b *Bucket) parseHeader(s string) error {
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid field '%s'", field)
+		}
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			return err
+		}
+		switch kv[0] {
+		case "version":
+			b.Version, err = strconv.Atoi(value)
+			if err == nil && b.Version > BucketFormatVersion {
+				err = fmt.Errorf("bucket format version %d is not supported (supported up to %d), update cfs", b.Version, BucketFormatVersion)
+			}
+		case "hash":
+			_, err = NewHash(value)
+			b.HashType = value
+		case "created":
+			b.Created, err = time.Parse(time.RFC3339, value)
+		case "uploader":
+			b.Uploader = value
+		case "parent":
+			if !isHash(value) {
+				err = fmt.Errorf("parent %s is not hash", value)
+			}
+			b.Parent = value
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseContent は、コンテンツの一行を読み込む
+func parseContent(line string) (Content, error) {
+	col := strings.Split(line, "\t")
+	if len(col) < contentColumns {
+		return Content{}, fmt.Errorf("too few columns, expect %d but %d", contentColumns, len(col))
+	}
+	if !isHash(col[0]) {
+		return Content{}, fmt.Errorf("invalid hash '%s'", col[0])
+	}
+	size, err := strconv.Atoi(col[2])
+	if err != nil {
+		return Content{}, fmt.Errorf("invalid size, %v", err)
+	}
+	t, err := time.Parse(time.RFC3339, col[3])
+	if err != nil {
+		return Content{}, fmt.Errorf("invalid time, %v", err)
+	}
+	origSize, err := strconv.Atoi(col[5])
+	if err != nil {
+		return Content{}, fmt.Errorf("invalid original size, %v", err)
+	}
+	attr, err := strconv.Atoi(col[6])
+	if err != nil {
+		return Content{}, fmt.Errorf("invalid attribute, %v", err)
+	}
+	keyId := ""
+	if len(col) > contentColumns {
+		keyId = col[7]
+	}
+	return Content{
+		Hash:     col[0],
+		Path:     col[1],
+		Size:     size,
+		Time:     t,
+		OrigHash: col[4],
+		OrigSize: origSize,
+		Attr:     ContentAttribute(attr),
+		KeyId:    keyId,
+	}, nil
+}
+
 // Merge bにfromの内容をマージする
 // 両方に存在する場合は、fromの内容で上書きされる
 func (b *Bucket) Merge(from *Bucket) {
@@ -145,15 +324,27 @@ func (b *Bucket) Merge(from *Bucket) {
 }
 
 func (b *Bucket) Sum(data []byte) string {
-	switch b.HashType {
-	case "sha1":
-		panic("not supported")
-		//return fmt.Sprintf("%x", sha1.Sum(data))
-	case "md5":
-		return fmt.Sprintf("%x", md5.Sum(data))
-	default:
-		panic("invalid hash type")
+	h := b.newHash()
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// SumReader は、rの内容を最後まで読んで、ハッシュとサイズを返す
+func (b *Bucket) SumReader(r io.Reader) (string, int64, error) {
+	h := b.newHash()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), n, nil
+}
+
+func (b *Bucket) newHash() hash.Hash {
+	h, err := NewHash(b.HashType)
+	if err != nil {
+		panic(err)
 	}
+	return h
 }
 
 func (b *Bucket) RemoveUntouched() {
@@ -170,6 +361,15 @@ func (b *Bucket) RemoveUntouched() {
 	b.Contents = newContents
 }
 
+// TotalSize は、バケットの全てのファイルの元のサイズの合計を返す
+func (b *Bucket) TotalSize() int64 {
+	var total int64
+	for _, c := range b.Contents {
+		total += int64(c.OrigSize)
+	}
+	return total
+}
+
 // Dump は、Bucketの内容をダンプする
 func (b *Bucket) Dump() string {
 	keys := []string{}
@@ -178,31 +378,56 @@ func (b *Bucket) Dump() string {
 	}
 	sort.Strings(keys)
 
-	r := make([]string, 0)
+	r := []string{b.dumpHeader()}
 	for _, k := range keys {
 		c := b.Contents[k]
-		r = append(
-			r,
-			strings.Join(
-				[]string{
-					c.Hash,
-					c.Path,
-					strconv.Itoa(c.Size),
-					c.Time.Format(time.RFC3339),
-					c.OrigHash,
-					strconv.Itoa(c.OrigSize),
-					strconv.Itoa(int(c.Attr)),
-				},
-				"\t"))
+		col := []string{
+			c.Hash,
+			c.Path,
+			strconv.Itoa(c.Size),
+			c.Time.Format(time.RFC3339),
+			c.OrigHash,
+			strconv.Itoa(c.OrigSize),
+			strconv.Itoa(int(c.Attr)),
+		}
+		if c.KeyId != "" {
+			col = append(col, c.KeyId)
+		}
+		r = append(r, strings.Join(col, "\t"))
 	}
 
 	return strings.Join(r, "\n") + "\n"
 }
+
+// dumpHeader は、ヘッダの行を作成する
+func (b *Bucket) dumpHeader() string {
+	hashType := b.HashType
+	if hashType == "" {
+		hashType = HashTypeMD5
+	}
+	fields := []string{
+		bucketHeader,
+		"version=" + strconv.Itoa(BucketFormatVersion),
+		"hash=" + hashType,
+	}
+	if !b.Created.IsZero() {
+		fields = append(fields, "created="+url.QueryEscape(b.Created.Format(time.RFC3339)))
+	}
+	if b.Uploader != "" {
+		fields = append(fields, "uploader="+url.QueryEscape(b.Uploader))
+	}
+	if b.Parent != "" {
+		fields = append(fields, "parent="+b.Parent)
+	}
+	return strings.Join(fields, " ")
+}
+
+// GetAttribute は、pathのファイルの圧縮や暗号化の属性を Option.AttributeRules に従って返す
 func (b *Bucket) GetAttribute(path string) ContentAttribute {
 	var attr = DefaultContentAttribute()
-	// TODO: とりあえずフィルタを固定している
-	if filepath.Ext(path) == ".ab" || filepath.Ext(path) == ".raw" || filepath.Ext(path) == ".pbx" || filepath.Ext(path) == ".mp4" {
-		attr = ContentAttribute(0)
+	_, rule := Option.FindAttributeRule(filepath.ToSlash(path))
+	if rule != nil {
+		attr = rule.Apply(attr)
 	}
 	return attr
 }
@@ -3,6 +3,7 @@ package cfs
 import (
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/url"
 	"os"
 	"os/exec"
@@ -261,4 +262,178 @@ func TestTag(t *testing.T) {
 		t.Error(err)
 		return
 	}
+
+	// 手で書き換えたタグのように、改行がついていても読み込める
+	err = c.Storage.UploadTag("newline", []byte(b.Hash+"\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadBucketFromStorage(c.Storage, "newline")
+	if err != nil {
+		t.Errorf("tag with newline must be loaded, but %v", err)
+	}
+	d, err := NewDownloader(c.Storage.DownloaderUrl().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.LoadBucket("newline")
+	if err != nil {
+		t.Errorf("tag with newline must be downloaded, but %v", err)
+	}
+}
+
+func TestCodecOption(t *testing.T) {
+	Option.Codec = "zstd"
+	defer func() { Option.Codec = "" }()
+
+	c, b, dir := setupBucket()
+	addFile(dir, "hoge", "hogehogehogehoge")
+	c.AddFiles(dir)
+	if b.Contents["hoge"].Attr.Codec() != CodecZstd {
+		t.Errorf("hoge must be compressed by zstd")
+	}
+
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 設定が変わっても、古いバケットを読み込める
+	Option.Codec = "lz4"
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+	data, err := d.FetchContent(b2.Contents["hoge"])
+	if err != nil || string(data) != "hogehogehogehoge" {
+		t.Errorf("cannot fetch zstd content, '%s' %v", data, err)
+	}
+}
+
+func TestHashType(t *testing.T) {
+	Option.HashType = HashTypeSHA256
+	defer func() { Option.HashType = "" }()
+
+	c, b, dir := setupBucket()
+	b.Tag = "sha256"
+	addFile(dir, "hoge", "hogehogehogehoge")
+	c.AddFiles(dir)
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Hash) != 64 || len(b.Contents["hoge"].Hash) != 64 {
+		t.Errorf("hash must be sha256, but %s", b.Hash)
+	}
+	if !strings.Contains(strings.SplitN(b.Dump(), "\n", 2)[0], " hash=sha256") {
+		t.Errorf("hash type must be recorded, but %s", b.Dump())
+	}
+
+	// 設定が変わっても、タグからsha256のバケットを読み込める
+	Option.HashType = ""
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), "sha256")
+	if b2.HashType != HashTypeSHA256 {
+		t.Errorf("hash type must be sha256, but %s", b2.HashType)
+	}
+	data, err := d.FetchContent(b2.Contents["hoge"])
+	if err != nil || string(data) != "hogehogehogehoge" {
+		t.Errorf("cannot fetch sha256 content, '%s' %v", data, err)
+	}
+
+	// ハッシュの種類が記録されていないバケットは、md5として読み込む
+	md5Bucket := NewBucket()
+	err = md5Bucket.Parse([]byte(strings.SplitN(b2.Dump(), "\n", 2)[1]))
+	if err != nil || md5Bucket.HashType != HashTypeMD5 {
+		t.Errorf("bucket without hash type must be md5, but %s %v", md5Bucket.HashType, err)
+	}
+
+	err = md5Bucket.Parse([]byte("#cfs-bucket version=2 hash=sha1\n"))
+	if err == nil {
+		t.Errorf("unknown hash type must be error")
+	}
+}
+
+func TestBucketFormat(t *testing.T) {
+	hash := "0123456789abcdef0123456789abcdef"
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	b := NewBucket()
+	b.Created = created
+	b.Uploader = "cfs user@host"
+	b.Parent = hash
+	b.Contents["hoge"] = Content{Path: "hoge", Hash: hash, OrigHash: hash, Time: created, Size: 4, OrigSize: 4, Attr: Compressed}
+
+	b2 := NewBucket()
+	err := b2.Parse([]byte(b.Dump()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.Version != BucketFormatVersion || !b2.Created.Equal(created) || b2.Uploader != b.Uploader || b2.Parent != hash {
+		t.Errorf("header must be parsed, but %v %v %v %v", b2.Version, b2.Created, b2.Uploader, b2.Parent)
+	}
+	if b2.Contents["hoge"] != b.Contents["hoge"] {
+		t.Errorf("content must be parsed, but %v", b2.Contents["hoge"])
+	}
+
+	// ヘッダのない古い形式や、知らない項目や列は読み込める
+	old := NewBucket()
+	err = old.Parse([]byte("#cfs-bucket version=2 unknown=1\n" +
+		"# comment\n" +
+		hash + "\thoge\t4\t2024-01-02T03:04:05Z\t" + hash + "\t4\t1\tkey\tunknown\n" +
+		hash + "\tfuga\t4\t2024-01-02T03:04:05Z\t" + hash + "\t4\t0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old.Contents) != 2 || old.Contents["hoge"].KeyId != "key" || old.Version != 2 {
+		t.Errorf("unknown columns must be ignored, but %v", old.Contents)
+	}
+
+	// 新しいバージョンの形式は、読み込めない
+	err = NewBucket().Parse([]byte("#cfs-bucket version=3\n"))
+	if err == nil || !strings.Contains(err.Error(), "version 3") {
+		t.Errorf("newer bucket format must be error, but %v", err)
+	}
+
+	// 不正な行は、行番号つきのエラーになる
+	for _, data := range []string{
+		"#cfs-bucket version=2\n" + hash + "\thoge\t4\n",
+		"#cfs-bucket version=2\n" + hash + "\thoge\tx\t2024-01-02T03:04:05Z\t" + hash + "\t4\t0\n",
+		"#cfs-bucket version=2\nhoge\n",
+	} {
+		err = NewBucket().Parse([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("malformed line must be error with line number, but %v", err)
+		}
+	}
+}
+
+func TestAdaptiveCompress(t *testing.T) {
+	Option.AdaptiveCompress = true
+	defer func() { Option.AdaptiveCompress = false }()
+
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	c, b, dir := setupBucket()
+	addFile(dir, "random.bin", string(random))
+	addFile(dir, "text.txt", strings.Repeat("hoge", 1024))
+	c.AddFiles(dir)
+
+	if b.Contents["random.bin"].Attr.Compressed() {
+		t.Errorf("random.bin must not be compressed")
+	}
+	if !b.Contents["random.bin"].Attr.Crypted() {
+		t.Errorf("random.bin must be crypted")
+	}
+	if !b.Contents["text.txt"].Attr.Compressed() {
+		t.Errorf("text.txt must be compressed")
+	}
+
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+	data, err := d.FetchContent(b2.Contents["random.bin"])
+	if err != nil || string(data) != string(random) {
+		t.Errorf("cannot fetch uncompressed content, %v", err)
+	}
 }
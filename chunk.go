@@ -0,0 +1,251 @@
+package cfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// chunkListHeader は、チャンクリストの先頭の行
+const chunkListHeader = "#cfs-chunks 1"
+
+// DefaultChunkSize は、ファイルを分割するときの平均のサイズのデフォルト値
+const DefaultChunkSize = 1024 * 1024
+
+// Chunk は、分割して保存したファイルの一つの部分を表す
+type Chunk struct {
+	Hash     string // 保存したデータのハッシュ
+	Size     int    // 保存したデータのサイズ
+	OrigSize int    // 元のデータのサイズ
+}
+
+// dumpChunkList は、チャンクの一覧をチャンクリストにする
+// チャンクリストは、ヘッダの行の後に、一行に一つのチャンクの "hash size origsize" をタブ区切りで並べたもの
+func dumpChunkList(chunks []Chunk) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(chunkListHeader + "\n")
+	for _, c := range chunks {
+		fmt.Fprintf(&buf, "%s\t%d\t%d\n", c.Hash, c.Size, c.OrigSize)
+	}
+	return buf.Bytes()
+}
+
+// parseChunkList は、チャンクリストを解析する
+func parseChunkList(data []byte) ([]Chunk, error) {
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if lines[0] != chunkListHeader {
+		return nil, fmt.Errorf("invalid chunk list header")
+	}
+
+	chunks := make([]Chunk, 0, len(lines)-1)
+	for i, line := range lines[1:] {
+		col := strings.Split(line, "\t")
+		if len(col) < 3 || !isHash(col[0]) {
+			return nil, fmt.Errorf("invalid chunk list at line %d", i+2)
+		}
+		size, err := strconv.Atoi(col[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk list at line %d, %v", i+2, err)
+		}
+		origSize, err := strconv.Atoi(col[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk list at line %d, %v", i+2, err)
+		}
+		chunks = append(chunks, Chunk{Hash: col[0], Size: size, OrigSize: origSize})
+	}
+	return chunks, nil
+}
+
+// isChunkTarget は、sizeのファイルを分割して保存するかどうかを返す
+func isChunkTarget(size int64) bool {
+	return Option.ChunkThreshold > 0 && size > Option.ChunkThreshold
+}
+
+// gearTable は、Gearハッシュで使う、バイトごとの乱数
+// 値を変えると分割する位置が変わり、以前にアップロードしたチャンクと重複排除されなくなるので、変えてはいけない
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x5cf5cf5cf5cf5cf5)
+	for i := range table {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker は、Gearハッシュ(rolling hash)を使って、内容に応じた位置でデータを分割する
+// ファイルの一部が変更されても、変更されていない部分は同じ位置で分割されるので、同じチャンクになる
+// 分割したチャンクの大きさは、平均サイズの1/4から4倍の間になる
+type chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int // bufのうち、前回返したチャンクの終わり
+	end   int // bufのうち、読み込んだデータの終わり
+	eof   bool
+	min   int
+	mask  uint64
+}
+
+func newChunker(r io.Reader, avgSize int) *chunker {
+	bits := uint(0)
+	for (1 << (bits + 1)) <= avgSize {
+		bits++
+	}
+	avg := 1 << bits
+	return &chunker{
+		r:    r,
+		buf:  make([]byte, avg*4),
+		min:  avg / 4,
+		mask: uint64(avg - 1),
+	}
+}
+
+// Next は、次のチャンクを返す。最後まで読んだら io.EOF を返す
+// 返したスライスの内容は、次に Next を呼ぶまでしか有効でない
+func (c *chunker) Next() ([]byte, error) {
+	// 残っているデータを先頭に移動して、最大サイズまで読み込む
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	if !c.eof {
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.end
+	if c.end > c.min {
+		var h uint64
+		for i := 0; i < c.end; i++ {
+			h = (h << 1) + gearTable[c.buf[i]]
+			if i >= c.min && h&c.mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+
+	c.start = cut
+	return c.buf[:cut], nil
+}
+
+// UploadChunked は、ファイルを内容に応じた位置で分割してそれぞれをアップロードし、
+// 分割したチャンクの一覧(チャンクリスト)をアップロードして、そのハッシュと保存したサイズ( chunkedSize )を返す
+// チャンクとチャンクリストは、attrから Chunked を除いた属性でエンコードする
+// origHashは、事前に計算したファイルのハッシュで、分割中にファイルが変更されていないかの確認に使う
+func (c *Client) UploadChunked(filename string, origHash string, fullPath string, attr ContentAttribute) (string, int, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	orig := &hashingReader{r: f, h: c.Bucket.newHash()}
+
+	chunkAttr := attr &^ Chunked
+	chunks := []Chunk{}
+	chunkSize := Option.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	ch := newChunker(orig, chunkSize)
+	for i := 0; ; i++ {
+		data, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", 0, err
+		}
+
+		// チャンクのバッファは再利用されるので、コピーしてからキューに積む
+		data = append([]byte{}, data...)
+		hash, size, err := c.Upload(fmt.Sprintf("%s#%d", filename, i), c.Bucket.Sum(data), data, chunkAttr)
+		if err != nil {
+			return "", 0, err
+		}
+		chunks = append(chunks, Chunk{Hash: hash, Size: size, OrigSize: len(data)})
+	}
+
+	if fmt.Sprintf("%x", orig.h.Sum(nil)) != origHash {
+		return "", 0, fmt.Errorf("'%s' is modified while uploading", filename)
+	}
+
+	list := dumpChunkList(chunks)
+	hash, size, err := c.Upload(filename, c.Bucket.Sum(list), list, chunkAttr)
+	if err != nil {
+		return "", 0, err
+	}
+	return hash, chunkedSize(size, chunks), nil
+}
+
+// chunkedSize は、分割したファイルの保存したサイズ(チャンクリストと全てのチャンクのサイズの合計)を返す
+func chunkedSize(listSize int, chunks []Chunk) int {
+	size := listSize
+	for _, chunk := range chunks {
+		size += chunk.Size
+	}
+	return size
+}
+
+// fetchChunkedTo は、チャンクリストのハッシュを指定して、全てのチャンクを取得してつなげたものをwに書き込む
+func (d *Downloader) fetchChunkedTo(hash string, attr ContentAttribute, w io.Writer) error {
+	chunkAttr := attr &^ Chunked
+
+	chunks, err := d.fetchChunkList(hash, attr)
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		err = d.fetchDecoded(chunk.Hash, chunkAttr, w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadChunkList は、分割されたファイルのチャンクリストを取得する
+func (d *Downloader) LoadChunkList(c Content) ([]Chunk, error) {
+	if !c.Attr.Chunked() {
+		return nil, fmt.Errorf("%s is not chunked", c.Path)
+	}
+	return d.fetchChunkList(c.Hash, c.Attr)
+}
+
+// fetchChunkList は、チャンクリストのハッシュを指定して、チャンクリストを取得する
+func (d *Downloader) fetchChunkList(hash string, attr ContentAttribute) ([]Chunk, error) {
+	var buf bytes.Buffer
+	err := d.fetchDecoded(hash, attr&^Chunked, &buf)
+	if err != nil {
+		return nil, err
+	}
+	return parseChunkList(buf.Bytes())
+}
+
+// loadChunkList は、ストレージから直接チャンクリストを読み込む
+func loadChunkList(s Storage, hash string, attr ContentAttribute) ([]Chunk, error) {
+	data, err := s.Get("data/" + hashPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	list, err := decodeWithKeyring(data, attr&^Chunked)
+	if err != nil {
+		return nil, err
+	}
+	return parseChunkList(list)
+}
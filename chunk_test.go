@@ -0,0 +1,178 @@
+package cfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func splitChunks(t *testing.T, data []byte, avgSize int) [][]byte {
+	chunks := [][]byte{}
+	ch := newChunker(bytes.NewReader(data), avgSize)
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+	return chunks
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := splitChunks(t, data, 16*1024)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("joined chunks must be same as original")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > 64*1024 || (i < len(chunks)-1 && len(chunk) < 4*1024) {
+			t.Errorf("invalid chunk size %d", len(chunk))
+		}
+	}
+
+	// 途中にデータを挿入しても、ほとんどのチャンクは変わらない
+	modified := append(append(append([]byte{}, data[:500000]...), []byte("inserted")...), data[500000:]...)
+	known := map[string]bool{}
+	for _, chunk := range chunks {
+		known[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range splitChunks(t, modified, 16*1024) {
+		if !known[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("only a few chunks must be changed, but %d/%d", changed, len(chunks))
+	}
+}
+
+func TestChunkList(t *testing.T) {
+	chunks := []Chunk{{Hash: sumLike("", []byte("a")), Size: 10, OrigSize: 20}, {Hash: sumLike("", []byte("b")), Size: 30, OrigSize: 40}}
+	parsed, err := parseChunkList(dumpChunkList(chunks))
+	if err != nil || len(parsed) != 2 || parsed[1] != chunks[1] {
+		t.Errorf("invalid chunk list %v, %v", parsed, err)
+	}
+
+	_, err = parseChunkList([]byte("hoge\tfuga\n"))
+	if err == nil {
+		t.Errorf("invalid chunk list must be error")
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	oldOption := *Option
+	defer func() { *Option = oldOption }()
+	Option.ChunkThreshold = 1024
+	Option.ChunkSize = 4 * 1024
+
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	c, b, dir := setupBucket()
+	b.Tag = "chunk-test"
+	addFile(dir, "large", string(data))
+	addFile(dir, "small", "small")
+	c.AddFiles(dir)
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !b.Contents["large"].Attr.Chunked() || b.Contents["small"].Attr.Chunked() {
+		t.Errorf("only large file must be chunked")
+	}
+
+	// Size は、チャンクリストだけでなくチャンクのサイズも含む(ランダムなデータは圧縮されない)
+	if size := b.Contents["large"].Size; size < len(data) {
+		t.Errorf("size of chunked file must include chunks, but %d", size)
+	}
+
+	objects, err := c.Storage.List("data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ダウンロードすると、元のファイルに戻る
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+	fetched, err := d.FetchContent(b2.Contents["large"])
+	if err != nil || !bytes.Equal(fetched, data) {
+		t.Errorf("cannot fetch chunked file, %v", err)
+	}
+
+	out, err := ioutil.TempDir("", "cfs-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Sync(b2, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, err := ioutil.ReadFile(filepath.Join(out, "large"))
+	if err != nil || !bytes.Equal(synced, data) {
+		t.Errorf("cannot sync chunked file, %v", err)
+	}
+
+	// チャンクはガーベージコレクトされない
+	result, err := CollectGarbage(c.Storage, GcOption{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Garbage) != 0 {
+		t.Errorf("chunks must not be garbage, but %v", result.Garbage)
+	}
+
+	// 一部を変更すると、変更された部分のチャンクだけがアップロードされる
+	oldHash := b.Hash
+	data[100*1024] ^= 1
+	addFile(dir, "large", string(data))
+	c2 := &Client{Bucket: b, Storage: c.Storage}
+	c2.Init()
+	c2.AddFiles(dir)
+	err = c2.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects2, err := c.Storage.List("data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 変更されたチャンク、チャンクリスト、バケットの分だけ増える
+	if added := len(objects2) - len(objects); added < 3 || added > 5 {
+		t.Errorf("only changed chunks must be uploaded, but %d objects added", added)
+	}
+
+	// 差分のダウンロードするサイズは、追加されたチャンクとチャンクリストのサイズの合計になる
+	exists := map[string]bool{}
+	for _, obj := range objects {
+		exists[obj.Path] = true
+	}
+	var expected int64
+	for _, obj := range objects2 {
+		if !exists[obj.Path] && obj.Path != "data/"+hashPath(b.Hash) {
+			expected += obj.Size
+		}
+	}
+	d, oldBucket := setupBucketFromURL(c.Storage.DownloaderUrl(), oldHash)
+	newBucket, err := d.LoadBucket(b.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := oldBucket.Diff(newBucket).Summary(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.DownloadBytes != expected {
+		t.Errorf("download size must be %d, but %d", expected, summary.DownloadBytes)
+	}
+}
@@ -1,12 +1,17 @@
 package cfs
 
 import (
+	"context"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/text/unicode/norm"
@@ -16,14 +21,58 @@ type uploadRequest struct {
 	Filename string
 	Hash     string
 	Data     []byte
+	File     string // Dataの代わりに、このファイルの内容をアップロードする
+	Size     int64  // Fileのサイズ
+	Temp     bool   // Fileがアップロード後に削除する一時ファイルかどうか
 }
 
+// cleanup は、アップロードが終わった(または中止した)リクエストの一時ファイルを削除する
+func (req *uploadRequest) cleanup() {
+	if req.Temp {
+		os.Remove(req.File)
+	}
+}
+
+// UploadFailure はアップロードに失敗したファイルとその原因を表す
+type UploadFailure struct {
+	Filename string
+	Hash     string
+	Err      error
+}
+
+// UploadError はアップロードに失敗した全てのファイルのエラーをまとめたもの
+type UploadError struct {
+	Failures []UploadFailure
+}
+
+func (e *UploadError) Error() string {
+	msgs := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		msgs = append(msgs, fmt.Sprintf("'%s' (%s): %v", f.Filename, f.Hash, f.Err))
+	}
+	return fmt.Sprintf("failed to upload %d files, %s", len(e.Failures), strings.Join(msgs, ", "))
+}
+
+// DefaultMaxQueuedBytes は、アップロードのキューに積むメモリ上のデータの量の上限のデフォルト値
+const DefaultMaxQueuedBytes = 256 * 1024 * 1024
+
 type Client struct {
-	Bucket    *Bucket
-	Storage   Storage
-	MaxWorker int
-	waitGroup sync.WaitGroup
-	queue     chan uploadRequest
+	Bucket     *Bucket
+	Storage    Storage
+	MaxWorker  int
+	Retry      *RetryPolicy   // nilなら Option.RetryPolicy() を使う
+	Ignore     *IgnoreMatcher // nilなら ExcludePatterns を使う
+	ForceTag   bool           // 保護されたタグ(Option.ProtectedTags)も上書きするかどうか
+	ExpectTag  string         // 空でなければ、タグがこのバケットのハッシュ(存在しないことを期待するなら TagAbsent)を指している場合だけ更新する
+	RetryCount int64          // アップロードでリトライした回数の合計
+	MaxQueued  int64          // キューに積むメモリ上のデータの量の上限(byte, 0なら DefaultMaxQueuedBytes)
+	waitGroup  sync.WaitGroup
+	queue      chan uploadRequest
+	queued     *byteLimiter
+	ctx        context.Context
+	cancel     context.CancelFunc
+	mutex      sync.Mutex
+	failures   []UploadFailure
 }
 
 func (c *Client) Init() error {
@@ -31,7 +80,17 @@ func (c *Client) Init() error {
 		c.MaxWorker = 32
 	}
 
+	if c.ExpectTag != "" && c.ExpectTag != TagAbsent && !isHash(c.ExpectTag) {
+		return fmt.Errorf("expected tag must be bucket hash or '%s', but '%s'", TagAbsent, c.ExpectTag)
+	}
+
+	if c.MaxQueued == 0 {
+		c.MaxQueued = DefaultMaxQueuedBytes
+	}
+
 	c.queue = make(chan uploadRequest, c.MaxWorker)
+	c.queued = newByteLimiter(c.MaxQueued)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
 	c.waitGroup.Add(c.MaxWorker)
 	for i := 0; i < c.MaxWorker; i++ {
@@ -45,15 +104,133 @@ func (c *Client) uploadWorker() {
 	defer c.waitGroup.Done()
 
 	for req := range c.queue {
-		err := c.Storage.Upload(req.Filename, req.Hash, req.Data, false)
-		if err != nil {
-			panic(err)
+		// 失敗したファイルがあれば、残りはアップロードせずに読み捨てる
+		if c.ctx.Err() == nil {
+			err := c.upload(req)
+			if err != nil {
+				c.fail(req, err)
+			}
+		}
+		req.cleanup()
+		c.queued.release(int64(len(req.Data)))
+	}
+}
+
+func (c *Client) retryPolicy() RetryPolicy {
+	if c.Retry != nil {
+		return *c.Retry
+	}
+	return Option.RetryPolicy()
+}
+
+// upload は、一時的なエラーならリトライしながらストレージにアップロードする
+func (c *Client) upload(req uploadRequest) error {
+	count, err := c.retryPolicy().Do(fmt.Sprintf("uploading '%s'", req.Filename), c.Storage.IsRetryable, func() error {
+		if req.File == "" {
+			return c.Storage.Upload(req.Filename, req.Hash, req.Data, false)
+		}
+		return c.uploadFile(req)
+	})
+	atomic.AddInt64(&c.RetryCount, int64(count))
+	return err
+}
+
+// uploadFile は、リクエストのファイルをストリーミングでアップロードする
+// 一時ファイルでない場合は、アップロード中にファイルが変更されていないかをハッシュで確認する
+func (c *Client) uploadFile(req uploadRequest) error {
+	f, err := os.Open(req.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if req.Temp {
+		return c.Storage.UploadReader(req.Filename, req.Hash, f, req.Size, false)
+	}
+
+	r := &hashingReader{r: f, h: c.Bucket.newHash()}
+	err = c.Storage.UploadReader(req.Filename, req.Hash, r, req.Size, false)
+	if err != nil {
+		return err
+	}
+
+	// すでにアップロード済みで、一度も読まれなかった場合は確認しない
+	if r.n == 0 && req.Size > 0 {
+		return nil
+	}
+	if fmt.Sprintf("%x", r.h.Sum(nil)) != req.Hash {
+		// 違う内容のデータが残ると、同じハッシュのファイルが壊れてしまうので、削除できなかったこともエラーに含める
+		if err := c.Storage.Delete("data/" + hashPath(req.Hash)); err != nil {
+			return fmt.Errorf("'%s' is modified while uploading, and cannot delete uploaded data %s, %v", req.Filename, req.Hash, err)
 		}
+		return fmt.Errorf("'%s' is modified while uploading", req.Filename)
+	}
+	return nil
+}
+
+// hashingReader は、読み込んだ内容のハッシュとサイズを計算するReader
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// countingWriter は、書き込んだサイズを数えるWriter
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// uploadTag は、一時的なエラーならリトライしながらタグをアップロードする
+// expectedについては Storage.UploadTag を参照
+func (c *Client) uploadTag(tag string, body []byte, expected string) error {
+	count, err := c.retryPolicy().Do(fmt.Sprintf("uploading tag '%s'", tag), c.Storage.IsRetryable, func() error {
+		return c.Storage.UploadTag(tag, body, expected)
+	})
+	atomic.AddInt64(&c.RetryCount, int64(count))
+	return err
+}
+
+// fail はアップロードの失敗を記録して、キューをキャンセルする
+func (c *Client) fail(req uploadRequest, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.failures = append(c.failures, UploadFailure{Filename: req.Filename, Hash: req.Hash, Err: err})
+	c.cancel()
+	c.queued.close()
+}
+
+// uploadError は、アップロードに失敗したファイルがあればそれをまとめたエラーを返す
+func (c *Client) uploadError() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.failures) == 0 {
+		return nil
 	}
+
+	failures := make([]UploadFailure, len(c.failures))
+	copy(failures, c.failures)
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Filename < failures[j].Filename })
+	return &UploadError{Failures: failures}
 }
 
 func (c *Client) Encode(origHash string, origData []byte, attr ContentAttribute) (hash string, data []byte, err error) {
-	data, hashChanged, err := encode(origData, Option.EncryptKey, Option.EncryptIv, attr)
+	data, hashChanged, err := encodeWithKeyId(origData, keyIdOf(attr), attr)
 	if err != nil {
 		return
 	}
@@ -73,13 +250,142 @@ func (c *Client) Upload(filename string, origHash string, origData []byte, attr
 		return "", 0, err
 	}
 
-	c.queue <- uploadRequest{Filename: filename, Hash: hash, Data: data}
+	err = c.enqueue(uploadRequest{Filename: filename, Hash: hash, Data: data})
+	if err != nil {
+		return "", 0, err
+	}
 
 	return hash, len(data), nil
 }
 
+// enqueue は、エンコード済みのデータをアップロードのキューに追加する
+// メモリ上のデータ(Data)は、アップロード中のものも含めて合計が MaxQueued を超えないように、空くまで待つ
+// (ファイルからアップロードするリクエストはメモリを使わないので、キューの長さだけで制限される)
+func (c *Client) enqueue(req uploadRequest) error {
+	size := int64(len(req.Data))
+	if !c.queued.acquire(size) {
+		req.cleanup()
+		return c.uploadError()
+	}
+
+	select {
+	case <-c.ctx.Done():
+		req.cleanup()
+		c.queued.release(size)
+		return c.uploadError()
+	case c.queue <- req:
+	}
+	return nil
+}
+
+// byteLimiter は、使用中のバイト数の合計を上限以下に制限する
+// 1つで上限を超えるものは、他に使用中のものがなくなれば使用できる
+type byteLimiter struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	max    int64
+	used   int64
+	closed bool
+}
+
+func newByteLimiter(max int64) *byteLimiter {
+	l := &byteLimiter{max: max}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// acquire は、nバイトを使用できるまで待つ、close された場合は false を返す
+func (l *byteLimiter) acquire(n int64) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for !l.closed && l.used > 0 && l.used+n > l.max {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return false
+	}
+	l.used += n
+	return true
+}
+
+func (l *byteLimiter) release(n int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.used -= n
+	l.cond.Broadcast()
+}
+
+// close は、待っている acquire を全て失敗させる
+func (l *byteLimiter) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// UploadFile は、ファイルの内容をメモリに読み込まずに、エンコードしてアップロードのキューに追加する
+// エンコードが必要な場合は、一時ファイルにエンコードしながらハッシュを計算する
+// origHashは、事前に計算したファイルのハッシュで、エンコード中にファイルが変更されていないかの確認に使う
+func (c *Client) UploadFile(filename string, origHash string, fullPath string, attr ContentAttribute) (string, int64, error) {
+	if !attr.Compressed() && !attr.Crypted() && !attr.AuthCrypted() {
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return "", 0, err
+		}
+		err = c.enqueue(uploadRequest{Filename: filename, Hash: origHash, File: fullPath, Size: info.Size()})
+		if err != nil {
+			return "", 0, err
+		}
+		return origHash, info.Size(), nil
+	}
+
+	src, err := os.Open(fullPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile("", "cfs-upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	req := uploadRequest{Filename: filename, File: tmp.Name(), Temp: true}
+
+	orig := &hashingReader{r: src, h: c.Bucket.newHash()}
+	encoded := c.Bucket.newHash()
+	w := &countingWriter{w: io.MultiWriter(tmp, encoded)}
+	_, err = encodeStream(w, orig, keyIdOf(attr), attr)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && fmt.Sprintf("%x", orig.h.Sum(nil)) != origHash {
+		err = fmt.Errorf("'%s' is modified while uploading", filename)
+	}
+	if err != nil {
+		req.cleanup()
+		return "", 0, err
+	}
+
+	req.Hash = fmt.Sprintf("%x", encoded.Sum(nil))
+	req.Size = w.n
+	err = c.enqueue(req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return req.Hash, req.Size, nil
+}
+
 func (c *Client) AddFiles(root string) error {
-	return filepath.Walk(root, func(path2 string, info os.FileInfo, err error) error {
+	ignore := c.Ignore
+	if ignore == nil {
+		ignore = NewIgnoreMatcher(ExcludePatterns)
+	}
+
+	return ignore.Walk(root, func(path2 string, info os.FileInfo, err error) error {
 		// OSXのためにUTF-8文字列を正規化する See: https://text.baldanders.info/golang/unicode-normalization/
 		path2 = norm.NFC.String(path2)
 
@@ -93,32 +399,15 @@ func (c *Client) AddFiles(root string) error {
 			return nil
 		}
 
-		// TODO: filepath.Matchがちゃんと働かないため、とりあえず対応
-		ext := filepath.Ext(path2)
-		base := filepath.Base(path2)
-		if strings.HasPrefix(base, ".") || strings.HasPrefix(base, "#") ||
-			strings.HasSuffix(base, "~") ||
-			ext == ".meta" || ext == ".manifest" || ext == ".tmx" {
-			return nil
-		}
-
-		if path2 != "." {
-			for _, pat := range ExcludePatterns {
-				if match, err := filepath.Match(pat, path2); match || err != nil {
-					if info.Mode().IsDir() {
-						return filepath.SkipDir
-					} else {
-						return nil
-					}
-				}
-			}
-		}
-
 		if !info.Mode().IsDir() {
+			var err error
 			if root == "." || root == path2 {
-				c.AddFile("", path2, info)
+				_, err = c.AddFile("", path2, info)
 			} else {
-				c.AddFile(root, path2[len(root)+1:], info)
+				_, err = c.AddFile(root, path2[len(root)+1:], info)
+			}
+			if err != nil {
+				return err
 			}
 		} else {
 			if !Option.Recursive && root != path2 {
@@ -147,6 +436,7 @@ func (c *Client) AddFile(root string, relative string, info os.FileInfo) (bool,
 			OrigHash: old.OrigHash,
 			OrigSize: old.OrigSize,
 			Attr:     old.Attr,
+			KeyId:    old.KeyId,
 			Touched:  true,
 		}
 		if !info.ModTime().After(old.Time.Add(time.Second)) && info.Size() == int64(old.OrigSize) { // ファイルシステムによって誤差があるため、１秒追加する
@@ -154,6 +444,10 @@ func (c *Client) AddFile(root string, relative string, info os.FileInfo) (bool,
 		}
 	}
 
+	if isChunkTarget(info.Size()) || (Option.StreamThreshold > 0 && info.Size() > Option.StreamThreshold && canEncodeStream(b.GetAttribute(relative))) {
+		return c.addLargeFile(key, relative, fullPath, info, old, found)
+	}
+
 	origData, err := ioutil.ReadFile(fullPath)
 	if err != nil {
 		return false, err
@@ -167,7 +461,7 @@ func (c *Client) AddFile(root string, relative string, info os.FileInfo) (bool,
 		return false, nil
 	}
 
-	attr := b.GetAttribute(relative)
+	attr := adaptCompression(relative, origData, b.GetAttribute(relative))
 	hash, size, err := c.Upload(relative, origHash, origData, attr)
 	if err != nil {
 		return false, err
@@ -185,12 +479,99 @@ func (c *Client) AddFile(root string, relative string, info os.FileInfo) (bool,
 		OrigHash: origHash,
 		OrigSize: len(origData),
 		Attr:     attr,
+		KeyId:    keyIdOf(attr),
+		Touched:  true,
+	}
+
+	return true, nil
+}
+
+// addLargeFile は、 Option.StreamThreshold より大きいファイルを、全体をメモリに読み込まずに追加する
+// 変更されたかどうかを判断するためにハッシュを計算してから、もう一度読み込んでアップロードする
+// Option.ChunkThreshold より大きいファイルは、分割してアップロードする
+func (c *Client) addLargeFile(key string, relative string, fullPath string, info os.FileInfo, old Content, found bool) (bool, error) {
+	b := c.Bucket
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return false, err
+	}
+	origHash, origSize, err := b.SumReader(f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+
+	if found && old.OrigHash == origHash {
+		old.Time = info.ModTime() // 時間だけ更新する
+		old.Touched = true
+		b.Contents[key] = old
+		return false, nil
+	}
+
+	attr := b.GetAttribute(relative)
+	if Option.AdaptiveCompress && attr.Compressed() {
+		// 全体を読み込まないように、 CompressSampleSize が0でも先頭だけで判断する
+		sampleSize := Option.CompressSampleSize
+		if sampleSize <= 0 {
+			sampleSize = 64 * 1024
+		}
+		sample, err := readHead(fullPath, sampleSize)
+		if err != nil {
+			return false, err
+		}
+		attr = adaptCompression(relative, sample, attr)
+	}
+
+	var hash string
+	var size int64
+	if isChunkTarget(info.Size()) {
+		attr |= Chunked
+		var n int
+		hash, n, err = c.UploadChunked(relative, origHash, fullPath, attr)
+		size = int64(n)
+	} else {
+		hash, size, err = c.UploadFile(relative, origHash, fullPath, attr)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if Verbose {
+		fmt.Printf("changed file %-12s (%s)\n", relative, hash)
+	}
+
+	b.Contents[key] = Content{
+		Path:     key,
+		Hash:     hash,
+		Size:     int(size),
+		Time:     info.ModTime(),
+		OrigHash: origHash,
+		OrigSize: int(origSize),
+		Attr:     attr,
+		KeyId:    keyIdOf(attr),
 		Touched:  true,
 	}
 
 	return true, nil
 }
 
+// readHead は、ファイルの先頭のsizeバイトを読み込む
+func readHead(file string, size int) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, size)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
 func (c *Client) AddContent(relative string, content []byte) (bool, error) {
 	b := c.Bucket
 
@@ -201,7 +582,7 @@ func (c *Client) AddContent(relative string, content []byte) (bool, error) {
 
 	origHash := b.Sum(content)
 
-	attr := b.GetAttribute(relative)
+	attr := adaptCompression(relative, content, b.GetAttribute(relative))
 	hash, size, err := c.Upload(relative, origHash, content, attr)
 	if err != nil {
 		return false, err
@@ -219,18 +600,31 @@ func (c *Client) AddContent(relative string, content []byte) (bool, error) {
 		OrigHash: origHash,
 		OrigSize: len(content),
 		Attr:     attr,
+		KeyId:    keyIdOf(attr),
 		Touched:  true,
 	}
 
 	return true, nil
 }
 
+// Finish は全てのアップロードの完了を待ち、バケットとタグを保存する
+// アップロードに失敗したファイルがあれば、バケットは保存せずに *UploadError を返す
 func (c *Client) Finish() error {
 
 	close(c.queue)
 	c.waitGroup.Wait()
+	c.cancel()
 
-	err := c.UploadBucket()
+	if Verbose && c.RetryCount > 0 {
+		fmt.Printf("retried %d times while uploading\n", c.RetryCount)
+	}
+
+	err := c.uploadError()
+	if err != nil {
+		return err
+	}
+
+	err = c.UploadBucket()
 	if err != nil {
 		return err
 	}
@@ -241,6 +635,28 @@ func (c *Client) Finish() error {
 func (c *Client) UploadBucket() error {
 	b := c.Bucket
 
+	// タグが指していたバケットを、履歴として記録する
+	b.Parent = ""
+	if b.Tag != "" {
+		parent, err := c.currentTagHash(b.Tag)
+		if err != nil {
+			return err
+		}
+		err = checkTagWritable(b.Tag, parent, c.ForceTag)
+		if err != nil {
+			return err
+		}
+		// バケットを書き込む前に、他からタグが更新されていないか確認する
+		err = checkExpectedTag(b.Tag, tagBody(parent), nil, c.ExpectTag)
+		if err != nil {
+			return err
+		}
+		b.Parent = parent
+	}
+
+	// アップロードした時刻とユーザーはタグの履歴に記録するので、同じファイルなら同じハッシュになるように、バケットには記録しない
+	b.Created = time.Time{}
+	b.Uploader = ""
 	origData := []byte(b.Dump())
 	origHash := b.Sum(origData)
 
@@ -249,28 +665,25 @@ func (c *Client) UploadBucket() error {
 		return err
 	}
 
-	err = c.Storage.Upload("*bucket*", hash, data, false)
+	err = c.upload(uploadRequest{Filename: "*bucket*", Hash: hash, Data: data})
 	if err != nil {
 		return err
 	}
 	b.Hash = hash
 
-	// バケットの保存先が設定されているなら保存する
-	if b.Path != "" {
-		err = ioutil.WriteFile(filepath.FromSlash(b.Path), origData, 0666)
-		if err != nil {
-			return err
-		}
-
-		ioutil.WriteFile(filepath.FromSlash(b.Path)+".hash", []byte(b.Hash), 0666)
-		if Verbose {
-			fmt.Printf("write bucket to '%s' (%s)\n", b.Path, b.Hash)
-		}
+	err = c.saveBucketFile(origData)
+	if err != nil {
+		return err
 	}
 
 	// タグが設定されているなら、保存する
 	if b.Tag != "" {
-		err = c.Storage.UploadTag(b.Tag, []byte(b.Hash))
+		// 読み込んだ時から他に更新されていた場合は、上書きせずにエラーにする
+		err = c.uploadTag(b.Tag, []byte(b.Hash), expectedTag(b.Parent))
+		if err != nil {
+			return err
+		}
+		err = c.recordTagHistory(b.Tag, newTagHistoryEntry(TagActionUpload, b.Hash, b.Parent))
 		if err != nil {
 			return err
 		}
@@ -278,3 +691,22 @@ func (c *Client) UploadBucket() error {
 
 	return nil
 }
+
+// saveBucketFile は、バケットの保存先が設定されているなら保存する
+func (c *Client) saveBucketFile(origData []byte) error {
+	b := c.Bucket
+	if b.Path == "" {
+		return nil
+	}
+
+	err := ioutil.WriteFile(filepath.FromSlash(b.Path), origData, 0666)
+	if err != nil {
+		return err
+	}
+
+	ioutil.WriteFile(filepath.FromSlash(b.Path)+".hash", []byte(b.Hash), 0666)
+	if Verbose {
+		fmt.Printf("write bucket to '%s' (%s)\n", b.Path, b.Hash)
+	}
+	return nil
+}
@@ -1,12 +1,18 @@
 package cfs
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestUploadWithFailure(t *testing.T) {
-	bucket := &Bucket{HashType: "md5", Contents: make(map[string]Content)}
+	bucket := &Bucket{Tag: "test", HashType: "md5", Contents: make(map[string]Content)}
 
 	storage, err := NewDummyStorage("")
 	if err != nil {
@@ -15,7 +21,7 @@ func TestUploadWithFailure(t *testing.T) {
 	storage.onUpload = func(filename string, hash string, body []byte, overwrite bool) error {
 		if filename == "error" {
 			time.Sleep(time.Millisecond * 100) // Wait a while
-			// return errors.Errorf("error for DummyStorage") // tODO: enable for testing
+			return errors.Errorf("error for DummyStorage")
 		}
 		return nil
 	}
@@ -30,9 +36,221 @@ func TestUploadWithFailure(t *testing.T) {
 	client.AddContent("fuga", []byte("hoge"))
 	client.AddContent("error", []byte("error"))
 
+	err = client.Finish()
+	uploadErr, ok := err.(*UploadError)
+	if !ok {
+		t.Fatalf("Finish must return UploadError, but %v", err)
+	}
+	if len(uploadErr.Failures) != 1 || uploadErr.Failures[0].Filename != "error" {
+		t.Errorf("invalid failures %v", uploadErr.Failures)
+	}
+	if !strings.Contains(err.Error(), "'error'") {
+		t.Errorf("error message must contain the failed file, but %v", err)
+	}
+
+	if bucket.Hash != "" || len(storage.tags) != 0 {
+		t.Errorf("bucket and tag must not be uploaded")
+	}
+
+}
+
+type temporaryError struct{}
+
+func (e temporaryError) Error() string   { return "temporary error for DummyStorage" }
+func (e temporaryError) Temporary() bool { return true }
+
+func TestUploadWithRetry(t *testing.T) {
+	bucket := &Bucket{Tag: "test", HashType: "md5", Contents: make(map[string]Content)}
+
+	storage, err := NewDummyStorage("")
+	if err != nil {
+		t.Errorf("Can't create DummyStorage.")
+	}
+	failCount := map[string]int{}
+	storage.onUpload = func(filename string, hash string, body []byte, overwrite bool) error {
+		if filename == "retry" && failCount[filename] < 2 {
+			failCount[filename]++
+			return temporaryError{}
+		}
+		if filename == "give-up" {
+			failCount[filename]++
+			return temporaryError{}
+		}
+		return nil
+	}
+
+	client := &Client{
+		Bucket:    bucket,
+		Storage:   storage,
+		MaxWorker: 1,
+		Retry:     &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	}
+	client.Init()
+
+	client.AddContent("retry", []byte("retry"))
+
 	err = client.Finish()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if client.RetryCount != 2 {
+		t.Errorf("retry count must be 2 but %d", client.RetryCount)
+	}
+	if len(storage.tags) != 1 {
+		t.Errorf("tag must be uploaded")
 	}
 
+	client = &Client{
+		Bucket:    bucket,
+		Storage:   storage,
+		MaxWorker: 1,
+		Retry:     &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	}
+	client.Init()
+
+	client.AddContent("give-up", []byte("give-up"))
+
+	err = client.Finish()
+	if _, ok := err.(*UploadError); !ok {
+		t.Errorf("Finish must return UploadError, but %v", err)
+	}
+	if failCount["give-up"] != 3 {
+		t.Errorf("upload must be tried 3 times but %d", failCount["give-up"])
+	}
+}
+
+func TestUploadLargeFile(t *testing.T) {
+	oldOption := *Option
+	defer func() { *Option = oldOption }()
+	Option.StreamThreshold = 16
+
+	dir, err := ioutil.TempDir("", "cfs-large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte(strings.Repeat("large file content\n", 1000))
+	file := filepath.Join(dir, "large")
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := []ContentAttribute{
+		NoContentAttribute,
+		Compressed,
+		ContentAttribute(Compressed).WithCodec(CodecZstd),
+		ContentAttribute(Compressed).WithCodec(CodecLz4),
+		Crypted,
+		Compressed | Crypted,
+	}
+	for _, attr := range attrs {
+		bucket := &Bucket{HashType: "md5", Contents: make(map[string]Content)}
+		storage, _ := NewDummyStorage("")
+		client := &Client{Bucket: bucket, Storage: storage}
+		client.Init()
+
+		hash, size, err := client.UploadFile("large", bucket.Sum(data), file, attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Finish(); err != nil {
+			t.Fatal(err)
+		}
+
+		body := storage.contents[hash]
+		if int64(len(body)) != size || bucket.Sum(body) != hash {
+			t.Errorf("invalid uploaded data with %v", attr)
+		}
+		decoded, err := decodeWithKeyring(body, attr)
+		if err != nil || string(decoded) != string(data) {
+			t.Errorf("cannot decode uploaded data with %v, %v", attr, err)
+		}
+	}
+
+	// AddFile でも、大きいファイルはストリーミングでアップロードされる
+	c, b, dir2 := setupBucket()
+	addFile(dir2, "large", string(data))
+	addFile(dir2, "small", "small")
+	if err := c.AddFiles(dir2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	content := b.Contents["large"]
+	if content.OrigHash != b.Sum(data) || content.OrigSize != len(data) || content.Size == 0 {
+		t.Errorf("invalid content %v", content)
+	}
+
+	// ハッシュを計算した後に変更された場合はエラー
+	bucket := &Bucket{HashType: "md5", Contents: make(map[string]Content)}
+	storage, _ := NewDummyStorage("")
+	client := &Client{Bucket: bucket, Storage: storage}
+	client.Init()
+	_, _, err = client.UploadFile("large", bucket.Sum([]byte("old")), file, Compressed)
+	if err == nil {
+		t.Errorf("modified file must be error")
+	}
+	client.Finish()
+}
+
+func TestByteLimiter(t *testing.T) {
+	l := newByteLimiter(10)
+
+	if !l.acquire(8) {
+		t.Fatal("acquire must succeed")
+	}
+
+	acquired := make(chan bool)
+	go func() { acquired <- l.acquire(5) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire over the limit must wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.release(8)
+	if !<-acquired {
+		t.Errorf("acquire must succeed after release")
+	}
+
+	// 1つで上限を超えるものは、他に使用中のものがなくなるまで待つ
+	go func() { acquired <- l.acquire(20) }()
+	l.release(5)
+	if !<-acquired {
+		t.Errorf("acquire over the limit must succeed when nothing is used")
+	}
+
+	go func() { acquired <- l.acquire(1) }()
+	l.close()
+	if <-acquired {
+		t.Errorf("acquire must fail after close")
+	}
+}
+
+func TestUploadUnchangedBucket(t *testing.T) {
+	c, b, dir := setupBucket()
+	addFile(dir, "hoge", "hoge")
+	c.AddFiles(dir)
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := b.Hash
+
+	// 同じファイルなら、アップロードした時刻やユーザーが違っても同じバケットになる
+	Option.Uploader = "other@host"
+	defer func() { Option.Uploader = "" }()
+	c = &Client{Bucket: b, Storage: c.Storage}
+	c.Init()
+	c.AddFiles(dir)
+	err = c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Hash != hash || !b.Created.IsZero() || b.Uploader != "" {
+		t.Errorf("unchanged bucket must have same hash, but %s (created %v, uploader %s)", b.Hash, b.Created, b.Uploader)
+	}
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+	"local.package/cfs"
+)
+
+var diffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     "show differences between two buckets",
+	Action:    doDiff,
+	ArgsUsage: "old-location new-location",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output in JSON",
+		},
+		cli.BoolFlag{
+			Name:  "summary, s",
+			Usage: "show only summary",
+		},
+	},
+}
+
+// diffOutput は、cfs diff --json で出力する内容
+type diffOutput struct {
+	Old     string
+	New     string
+	Summary cfs.DiffSummary
+	*cfs.BucketDiff
+}
+
+func doDiff(c *cli.Context) {
+	loadConfig(c)
+
+	var args = c.Args()
+	if len(args) != 2 {
+		fmt.Println("need just 2 arguments")
+		os.Exit(1)
+	}
+
+	downloader, err := cfs.NewDownloader(getDownloaderURL())
+	check(err)
+
+	oldBucket, err := downloader.LoadBucket(args[0])
+	check(err)
+	newBucket, err := downloader.LoadBucket(args[1])
+	check(err)
+
+	diff := oldBucket.Diff(newBucket)
+	summary, err := diff.Summary(downloader)
+	check(err)
+
+	if c.Bool("json") {
+		out := diffOutput{Old: oldBucket.Hash, New: newBucket.Hash, Summary: summary}
+		if !c.Bool("summary") {
+			out.BucketDiff = diff
+		}
+		data, err := json.MarshalIndent(out, "", "  ")
+		check(err)
+		fmt.Println(string(data))
+		return
+	}
+
+	if !c.Bool("summary") {
+		for _, e := range diff.Added {
+			fmt.Printf("A\t%s\n", e.Path)
+		}
+		for _, e := range diff.Removed {
+			fmt.Printf("D\t%s\n", e.Path)
+		}
+		for _, e := range diff.Modified {
+			fmt.Printf("M\t%s\n", e.Path)
+		}
+		for _, e := range diff.Renamed {
+			fmt.Printf("R\t%s -> %s\n", e.OldPath, e.Path)
+		}
+	}
+
+	fmt.Printf("%d added (%d bytes), %d removed (%d bytes), %d modified (%d bytes), %d renamed, %d bytes to download\n",
+		summary.Added, summary.AddedBytes, summary.Removed, summary.RemovedBytes,
+		summary.Modified, summary.ModifiedBytes, summary.Renamed, summary.DownloadBytes)
+}
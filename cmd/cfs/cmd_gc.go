@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli"
+	"local.package/cfs"
+)
+
+var gcCommand = cli.Command{
+	Name:      "gc",
+	Usage:     "delete data not referenced from any tag",
+	Action:    doGc,
+	ArgsUsage: "[pinned-bucket-hash ...]",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "show data to delete, but don't delete",
+		},
+		cli.DurationFlag{
+			Name:  "grace",
+			Value: 24 * time.Hour,
+			Usage: "keep data updated within this period",
+		},
+		cli.IntFlag{
+			Name:  "keep-history",
+			Usage: "keep buckets of tags up to this number of updates ago (-1 for all in the tag history)",
+		},
+	},
+}
+
+func doGc(c *cli.Context) {
+	loadConfig(c)
+
+	dryRun := c.Bool("dry-run")
+
+	storage, err := cfs.StorageFromString(cfs.Option.Cabinet)
+	check(err)
+
+	result, err := cfs.CollectGarbage(storage, cfs.GcOption{
+		PinnedBuckets: c.Args(),
+		GracePeriod:   c.Duration("grace"),
+		DryRun:        dryRun,
+		KeepHistory:   c.Int("keep-history"),
+	})
+	check(err)
+
+	var total int64
+	for _, obj := range result.Garbage {
+		if dryRun || cfs.Verbose {
+			fmt.Printf("%s\t%d\t%s\n", obj.Path, obj.Size, obj.ModTime.Format(time.RFC3339))
+		}
+		total += obj.Size
+	}
+
+	verb := "deleted"
+	if dryRun {
+		verb = "would delete"
+	}
+	fmt.Printf("%s %d objects (%d bytes), %d referenced, %d kept in grace period\n",
+		verb, len(result.Garbage), total, result.Referenced, result.Young)
+}
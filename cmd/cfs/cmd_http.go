@@ -2,12 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/urfave/cli"
@@ -90,10 +94,6 @@ func renderDirectory(w http.ResponseWriter, path string, list []cfs.Content) {
 }
 
 func renderFile(w http.ResponseWriter, downloader *cfs.Downloader, content cfs.Content) {
-	data, err := downloader.Fetch(content.Hash, content.Attr)
-	if err != nil {
-		panic(err)
-	}
 	// MIMEを設定する
 	mimetype := mime.TypeByExtension(filepath.Ext(content.Path))
 	if mimetype == "" {
@@ -105,10 +105,30 @@ func renderFile(w http.ResponseWriter, downloader *cfs.Downloader, content cfs.C
 		mimetype = "text/html; charset=shift_jis"
 	}
 
-	w.Header().Set("Content-Type", mimetype)
 	println(content.Path, mimetype)
 
-	w.Write(data)
+	// 途中まで送ってからハッシュの不一致に気づかないように、一時ファイルに展開して確認してから送る
+	tmp, err := ioutil.TempFile("", "cfs-http")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = downloader.FetchContentTo(content, tmp)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		fmt.Printf("cannot fetch %v, %v\n", content.Path, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("Content-Length", strconv.Itoa(content.OrigSize))
+	io.Copy(w, tmp)
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+	"local.package/cfs"
+)
+
+var logCommand = cli.Command{
+	Name:      "log",
+	Usage:     "show history of a tag",
+	Action:    doLog,
+	ArgsUsage: "location",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "n",
+			Value: 20,
+			Usage: "max number of buckets to show (0 for all)",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output in JSON",
+		},
+	},
+}
+
+// logEntry は、cfs log で表示する一回の更新(タグの履歴がない場合は一つのバケット)の情報
+type logEntry struct {
+	Time     time.Time // タグを更新した時刻(タグの履歴がない場合は、バケットを作成した時刻)
+	Action   string    `json:",omitempty"`
+	User     string    // タグを更新した(バケットをアップロードした)ユーザー
+	Hash     string
+	Previous string `json:",omitempty"`
+	Files    int
+	Size     int64
+	Delta    int64  // 一つ前のバケットからのサイズの増減
+	Parent   string `json:",omitempty"`
+	Error    string `json:",omitempty"` // バケットを読み込めなかった場合のエラー
+}
+
+func doLog(c *cli.Context) {
+	loadConfig(c)
+
+	var args = c.Args()
+	if len(args) != 1 {
+		fmt.Println("need just 1 arguments")
+		os.Exit(1)
+	}
+
+	limit := c.Int("n")
+
+	downloader, err := cfs.NewDownloader(getDownloaderURL())
+	check(err)
+
+	history, err := downloader.TagHistory(args[0])
+	check(err)
+
+	var entries []logEntry
+	if len(history) > 0 {
+		entries = tagLogEntries(downloader, history, limit)
+	} else {
+		// タグの履歴がない場合は、バケットの Parent をたどる
+		entries = bucketLogEntries(downloader, args[0], limit)
+	}
+
+	if c.Bool("json") {
+		out, err := json.MarshalIndent(entries, "", "  ")
+		check(err)
+		fmt.Println(string(out))
+		return
+	}
+
+	for _, e := range entries {
+		t := "-"
+		if !e.Time.IsZero() {
+			t = e.Time.Format(time.RFC3339)
+		}
+		action := e.Action
+		if action == "" {
+			action = "-"
+		}
+		user := e.User
+		if user == "" {
+			user = "-"
+		}
+		hash := e.Hash
+		if hash == "" {
+			hash = "-"
+		}
+		if e.Error != "" {
+			fmt.Printf("%s\t%s\t%s\t%s\t(%s)\n", t, action, hash, user, e.Error)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%d files\t%d bytes\t%+d\n", t, action, hash, user, e.Files, e.Size, e.Delta)
+	}
+}
+
+// tagLogEntries は、タグの履歴から、新しい順にlimit個の更新の情報を作成する
+func tagLogEntries(downloader *cfs.Downloader, history []cfs.TagHistoryEntry, limit int) []logEntry {
+	buckets := map[string]*cfs.Bucket{}
+	load := func(hash string) (*cfs.Bucket, error) {
+		if b, ok := buckets[hash]; ok {
+			return b, nil
+		}
+		b, err := downloader.LoadBucket(hash)
+		if err != nil {
+			return nil, err
+		}
+		buckets[hash] = b
+		return b, nil
+	}
+
+	entries := []logEntry{}
+	for i := len(history) - 1; i >= 0; i-- {
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		h := history[i]
+		e := logEntry{Time: h.Time, Action: h.Action, User: h.User, Hash: h.Hash, Previous: h.Previous}
+		if h.Hash != "" {
+			b, err := load(h.Hash)
+			if err != nil {
+				e.Error = fmt.Sprintf("bucket is not available, %v", err)
+				entries = append(entries, e)
+				continue
+			}
+			e.Files = len(b.Contents)
+			e.Size = b.TotalSize()
+			e.Parent = b.Parent
+		}
+		e.Delta = e.Size
+		if h.Previous != "" {
+			if prev, err := load(h.Previous); err == nil {
+				e.Delta = e.Size - prev.TotalSize()
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// bucketLogEntries は、locationのバケットから Parent をたどって、新しい順にlimit個のバケットの情報を作成する
+func bucketLogEntries(downloader *cfs.Downloader, location string, limit int) []logEntry {
+	// サイズの増減を計算するために、一つ多く取得する
+	fetchLimit := limit
+	if limit > 0 {
+		fetchLimit = limit + 1
+	}
+	history, err := downloader.History(location, fetchLimit)
+	check(err)
+
+	entries := make([]logEntry, 0, len(history))
+	for i, b := range history {
+		if limit > 0 && i >= limit {
+			break
+		}
+		size := b.TotalSize()
+		delta := size
+		if i+1 < len(history) {
+			delta = size - history[i+1].TotalSize()
+		}
+		entries = append(entries, logEntry{
+			Time:   b.Created,
+			User:   b.Uploader,
+			Hash:   b.Hash,
+			Files:  len(b.Contents),
+			Size:   size,
+			Delta:  delta,
+			Parent: b.Parent,
+		})
+	}
+
+	// 履歴の途中のバケットが存在しない場合は、そのことを表示する
+	last := history[len(history)-1]
+	if last.Parent != "" && (limit <= 0 || len(history) <= limit) {
+		entries = append(entries, logEntry{Hash: last.Parent, Error: "bucket is not available"})
+	}
+	return entries
+}
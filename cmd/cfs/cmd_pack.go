@@ -13,6 +13,7 @@ var packCommand = cli.Command{
 	Usage:     "pack specified dir",
 	Action:    doPack,
 	ArgsUsage: "packfile.cfspack dir [...]",
+	Flags:     ignoreFlags,
 }
 
 func doPack(c *cli.Context) {
@@ -24,8 +25,6 @@ func doPack(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	filter := c.GlobalString("filter-cmd")
-
 	packfile := args[0]
 
 	dir := args[1]
@@ -34,13 +33,11 @@ func doPack(c *cli.Context) {
 	defer w.Close()
 	check(err)
 
-	pak, err := pack.NewPackFileFromDir(dir)
+	pak, err := pack.NewPackFileFromDir(dir, ignoreMatcherFromFlags(c))
 	check(err)
 
-	if filter != "" {
-		pak, err = filterPackFile(filter, pak)
-		check(err)
-	}
+	pak, err = filterPackFile(c, pak)
+	check(err)
 
 	err = pack.Pack(w, pak, nil)
 	check(err)
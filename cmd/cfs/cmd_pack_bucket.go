@@ -23,7 +23,7 @@ func packFromBucket(b *cfs.Bucket, d *cfs.Downloader) (*pack.PackFile, error) {
 
 	entries := make([]pack.Entry, 0, len(b.Contents))
 	for _, c := range b.Contents {
-		data, err := d.Fetch(c.Hash, c.Attr)
+		data, err := d.FetchContent(c)
 		check(err)
 
 		entries = append(entries, pack.Entry{
@@ -55,12 +55,8 @@ func doPackBucket(c *cli.Context) {
 	bucket, err := downloader.LoadBucket(location)
 	check(err)
 
-	filter := c.GlobalString("filter-cmd")
-
-	if filter != "" {
-		bucket, err = filterBucket(filter, bucket)
-		check(err)
-	}
+	bucket, err = filterBucket(c, bucket)
+	check(err)
 
 	pak, err := packFromBucket(bucket, downloader)
 	check(err)
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/urfave/cli"
+	"local.package/cfs"
+)
+
+var rekeyCommand = cli.Command{
+	Name:      "rekey",
+	Usage:     "re-encrypt files in bucket with another key",
+	Action:    doRekey,
+	ArgsUsage: "location",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Value: "",
+			Usage: "key id to re-encrypt (empty for files encrypted by EncryptKey)",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Value: "",
+			Usage: "new key id (default: EncryptKeyId in config)",
+		},
+		cli.StringFlag{
+			Name:  "tag, t",
+			Value: "",
+			Usage: "tag name (default: location if it is a tag)",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Value: "",
+			Usage: "hash output file",
+		},
+		forceTagFlag,
+	},
+}
+
+func doRekey(c *cli.Context) {
+	loadConfig(c)
+
+	var args = c.Args()
+	if len(args) != 1 {
+		fmt.Println("need just 1 arguments")
+		os.Exit(1)
+	}
+
+	location := args[0]
+	output := c.String("output")
+
+	from := c.String("from")
+	to := c.String("to")
+	if to == "" {
+		to = cfs.Option.EncryptKeyId
+	}
+	if from == to {
+		fmt.Println("--from and --to must be different")
+		os.Exit(1)
+	}
+
+	downloader, err := cfs.NewDownloader(getDownloaderURL())
+	check(err)
+
+	bucket, err := downloader.LoadBucket(location)
+	check(err)
+
+	bucket.Tag = c.String("tag")
+	if bucket.Tag == "" && bucket.Hash != location {
+		bucket.Tag = location
+	}
+
+	storage, err := cfs.StorageFromString(cfs.Option.Cabinet)
+	check(err)
+
+	// 新しいバケットも新しい鍵で暗号化する
+	cfs.Option.EncryptKeyId = to
+
+	client := &cfs.Client{
+		Storage:  storage,
+		Bucket:   bucket,
+		ForceTag: c.Bool("force"),
+	}
+
+	check(client.Init())
+
+	count, err := client.Rekey(downloader, from, to)
+	check(err)
+
+	check(client.Finish())
+
+	fmt.Printf("%d files re-encrypted, new bucket %s\n", count, bucket.Hash)
+
+	if output != "" {
+		check(ioutil.WriteFile(output, []byte(bucket.Hash), 0777))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+	"local.package/cfs"
+)
+
+var tagCommand = cli.Command{
+	Name:  "tag",
+	Usage: "manage tags",
+	Subcommands: []cli.Command{
+		{
+			Name:      "set",
+			Usage:     "point a tag to a bucket",
+			Action:    doTagSet,
+			ArgsUsage: "tag location",
+			Flags:     []cli.Flag{forceTagFlag},
+		},
+		{
+			Name:      "rollback",
+			Usage:     "point a tag back to an older bucket in its history",
+			Action:    doTagRollback,
+			ArgsUsage: "tag",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "n",
+					Value: 1,
+					Usage: "number of older buckets in the tag history to roll back",
+				},
+				forceTagFlag,
+			},
+		},
+		{
+			Name:      "rm",
+			Usage:     "remove tags (data are deleted by gc)",
+			Action:    doTagRm,
+			ArgsUsage: "tag [...]",
+			Flags:     []cli.Flag{forceTagFlag},
+		},
+	},
+}
+
+var tagsCommand = cli.Command{
+	Name:   "tags",
+	Usage:  "list tags in cabinet",
+	Action: doTags,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output in JSON",
+		},
+	},
+}
+
+// expectTagFlag は、タグが他から更新されていないことを確認するオプション
+var expectTagFlag = cli.StringFlag{
+	Name:  "expect",
+	Usage: "update the tag only if it points to this bucket hash (\"" + cfs.TagAbsent + "\" if the tag must not exist)",
+}
+
+// forceTagFlag は、保護されたタグを上書き/削除するオプション
+var forceTagFlag = cli.BoolFlag{
+	Name:  "force",
+	Usage: "overwrite or remove protected tags",
+}
+
+func doTagSet(c *cli.Context) {
+	loadConfig(c)
+
+	var args = c.Args()
+	if len(args) != 2 {
+		fmt.Println("need just 2 arguments")
+		os.Exit(1)
+	}
+
+	storage, err := cfs.StorageFromString(cfs.Option.Cabinet)
+	check(err)
+
+	hash, err := cfs.SetTag(storage, args[0], args[1], c.Bool("force"))
+	check(err)
+
+	fmt.Printf("tag '%s' is set to %s\n", args[0], hash)
+}
+
+func doTagRollback(c *cli.Context) {
+	loadConfig(c)
+
+	var args = c.Args()
+	if len(args) != 1 {
+		fmt.Println("need just 1 arguments")
+		os.Exit(1)
+	}
+
+	storage, err := cfs.StorageFromString(cfs.Option.Cabinet)
+	check(err)
+
+	hash, err := cfs.RollbackTag(storage, args[0], c.Int("n"), c.Bool("force"))
+	check(err)
+
+	fmt.Printf("tag '%s' is rolled back to %s\n", args[0], hash)
+}
+
+func doTagRm(c *cli.Context) {
+	loadConfig(c)
+
+	var args = c.Args()
+	if len(args) == 0 {
+		fmt.Println("need at least 1 arguments")
+		os.Exit(1)
+	}
+
+	storage, err := cfs.StorageFromString(cfs.Option.Cabinet)
+	check(err)
+
+	for _, tag := range args {
+		check(cfs.RemoveTag(storage, tag, c.Bool("force")))
+		fmt.Printf("tag '%s' is removed\n", tag)
+	}
+}
+
+func doTags(c *cli.Context) {
+	loadConfig(c)
+
+	storage, err := cfs.StorageFromString(cfs.Option.Cabinet)
+	check(err)
+
+	tags, err := cfs.ListTagInfo(storage)
+	check(err)
+
+	if c.Bool("json") {
+		out, err := json.MarshalIndent(tags, "", "  ")
+		check(err)
+		fmt.Println(string(out))
+		return
+	}
+
+	for _, tag := range tags {
+		if tag.Error != "" {
+			fmt.Printf("%s\t(error: %s)\n", tag.Name, tag.Error)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\t%d files\t%d bytes\n", tag.Name, tag.Hash, tag.Updated.Format(time.RFC3339), tag.Files, tag.Size)
+	}
+}
@@ -29,8 +29,6 @@ var unpackCommand = cli.Command{
 func doUnpack(c *cli.Context) {
 	loadConfig(c)
 
-	filter := c.GlobalString("filter-cmd")
-
 	var args = c.Args()
 
 	if len(args) != 1 {
@@ -47,7 +45,7 @@ func doUnpack(c *cli.Context) {
 	pak, err := pack.Parse(f)
 	check(err)
 
-	pak, err = filterPackFile(filter, pak)
+	pak, err = filterPackFile(c, pak)
 	check(err)
 
 	if c.String("o") != "" {
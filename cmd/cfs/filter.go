@@ -3,17 +3,49 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
 
+	"github.com/urfave/cli"
 	"local.package/cfs"
 	"local.package/cfs/pack"
 )
 
-func filterBucket(cmd string, b *cfs.Bucket) (*cfs.Bucket, error) {
+// filterBucket は、--filter と --filter-cmd の指定に従ってバケットをフィルタする
+func filterBucket(c *cli.Context, b *cfs.Bucket) (*cfs.Bucket, error) {
+	f, err := cfs.ParseFilter(c.GlobalStringSlice("filter"))
+	if err != nil {
+		return nil, err
+	}
+	if !f.IsEmpty() {
+		b, err = f.FilterBucket(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return filterBucketByCommand(c.GlobalString("filter-cmd"), b)
+}
+
+// filterPackFile は、--filter と --filter-cmd の指定に従ってパックファイルをフィルタする
+func filterPackFile(c *cli.Context, pak *pack.PackFile) (*pack.PackFile, error) {
+	f, err := cfs.ParseFilter(c.GlobalStringSlice("filter"))
+	if err != nil {
+		return nil, err
+	}
+	if !f.IsEmpty() {
+		pak, err = pack.Filter(pak, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return filterPackFileByCommand(c.GlobalString("filter-cmd"), pak)
+}
+
+func filterBucketByCommand(cmd string, b *cfs.Bucket) (*cfs.Bucket, error) {
 	if cmd == "" {
 		return b, nil
 	}
@@ -24,7 +56,9 @@ func filterBucket(cmd string, b *cfs.Bucket) (*cfs.Bucket, error) {
 		files = append(files, e.Path)
 	}
 	files, err := runFilter(cmd, files)
-	check(err)
+	if err != nil {
+		return nil, err
+	}
 
 	fileDict := make(map[string]bool, len(entries))
 	for _, f := range files {
@@ -41,13 +75,13 @@ func filterBucket(cmd string, b *cfs.Bucket) (*cfs.Bucket, error) {
 	entries = newEntries
 
 	return &cfs.Bucket{
-		HashType: "md5",
+		HashType: b.HashType,
 		Contents: entries,
 		Tag:      b.Tag,
 	}, nil
 }
 
-func filterPackFile(cmd string, pak *pack.PackFile) (*pack.PackFile, error) {
+func filterPackFileByCommand(cmd string, pak *pack.PackFile) (*pack.PackFile, error) {
 	entries := pak.Entries
 	if cmd == "" {
 		return pak, nil
@@ -57,7 +91,9 @@ func filterPackFile(cmd string, pak *pack.PackFile) (*pack.PackFile, error) {
 		files = append(files, e.Path)
 	}
 	files, err := runFilter(cmd, files)
-	check(err)
+	if err != nil {
+		return nil, err
+	}
 
 	fileDict := make(map[string]bool, len(entries))
 	for _, f := range files {
@@ -74,8 +110,9 @@ func filterPackFile(cmd string, pak *pack.PackFile) (*pack.PackFile, error) {
 	entries = newEntries
 
 	return &pack.PackFile{
-		Version: pack.PackFileVersion,
-		Entries: entries,
+		Version:  pack.PackFileVersion,
+		HashType: pak.HashType,
+		Entries:  entries,
 	}, nil
 }
 
@@ -85,39 +122,86 @@ func runFilter(cmdStr string, files []string) ([]string, error) {
 		return nil, err
 	}
 	lf := regexp.MustCompile("\r\n|\n\r|\n|\r")
-	return lf.Split(strings.TrimRight(out, "\n"), -1), nil
+	return lf.Split(strings.TrimRight(out, "\r\n"), -1), nil
 }
 
 func runCommand(cmdStr string, input string) (string, error) {
-	commands := strings.Split(cmdStr, " ")
-	cmd := exec.Command(commands[0], commands[1:]...)
+	commands, err := splitCommandLine(cmdStr)
+	if err != nil {
+		return "", err
+	}
+	if len(commands) == 0 {
+		return "", fmt.Errorf("empty filter command")
+	}
 
+	cmd := exec.Command(commands[0], commands[1:]...)
+	cmd.Stdin = strings.NewReader(input)
 	cmd.Stderr = os.Stderr
 
-	stdin, err := cmd.StdinPipe()
-	check(err)
-
-	go func() {
-		_, err = io.Copy(stdin, bytes.NewBufferString(input))
-		check(err)
-		err = stdin.Close()
-		check(err)
-	}()
-
 	var outbuf bytes.Buffer
 	cmd.Stdout = &outbuf
 
-	err = cmd.Start()
-	check(err)
-
-	err = cmd.Wait()
-	out := outbuf.String()
+	err = cmd.Run()
 	if err != nil {
-		if out == "" {
-			return "", fmt.Errorf("no output from filter")
+		return "", fmt.Errorf("filter command '%s' failed: %v", cmdStr, err)
+	}
+
+	return outbuf.String(), nil
+}
+
+// splitCommandLine は、コマンドラインを引数に分割する
+// シングルクォート、ダブルクォート、バックスラッシュによるエスケープが使える
+func splitCommandLine(s string) ([]string, error) {
+	args := []string{}
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`+"`", runes[i+1]) {
+				i++
+				cur.WriteRune(runes[i])
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\':
+			if i+1 < len(runes) {
+				i++
+				cur.WriteRune(runes[i])
+			}
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
 		}
-		return "", err
 	}
 
-	return out, nil
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in '%s'", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
 }
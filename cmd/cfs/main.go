@@ -50,6 +50,10 @@ func main() {
 			Name:  "force, f",
 			Usage: "force upload(use no cache)",
 		},
+		cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "filter expression for files (e.g. \"include=*.png;size<1M;strip=assets\")",
+		},
 		cli.StringFlag{
 			Name:  "filter-cmd",
 			Usage: "command for filter files",
@@ -61,6 +65,10 @@ func main() {
 		mergeCommand,
 		catCommand,
 		lsCommand,
+		logCommand,
+		diffCommand,
+		tagCommand,
+		tagsCommand,
 		configCommand,
 		settingCommand,
 		httpCommand,
@@ -68,6 +76,8 @@ func main() {
 		unpackCommand,
 		packBucketCommand,
 		patchCommand,
+		gcCommand,
+		rekeyCommand,
 	}
 
 	err := app.Run(os.Args)
@@ -120,7 +130,7 @@ var uploadCommand = cli.Command{
 	Name:   "upload",
 	Usage:  "upload files to cabinet",
 	Action: doUpload,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "tag, t",
 			Value: "",
@@ -136,9 +146,31 @@ var uploadCommand = cli.Command{
 			Value: "",
 			Usage: "hash output file",
 		},
+		forceTagFlag,
+		expectTagFlag,
+	}, ignoreFlags...),
+}
+
+// ignoreFlags は、アップロードするファイルを選ぶオプション
+var ignoreFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "exclude files matching the pattern (.gitignore format, can be specified multiple times)",
+	},
+	cli.StringSliceFlag{
+		Name:  "include",
+		Usage: "include files matching the pattern even if excluded by other patterns",
 	},
 }
 
+// ignoreMatcherFromFlags は、デフォルトのパターンに --exclude/--include を加えたIgnoreMatcherを作成する
+func ignoreMatcherFromFlags(c *cli.Context) *cfs.IgnoreMatcher {
+	ignore := cfs.NewIgnoreMatcher(cfs.ExcludePatterns)
+	ignore.Exclude(c.StringSlice("exclude")...)
+	ignore.Include(c.StringSlice("include")...)
+	return ignore
+}
+
 var hex = []byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'A', 'B', 'C', 'D', 'E', 'F'}
 
 // ファイル名に使える文字列に変換する
@@ -193,6 +225,14 @@ func doUpload(c *cli.Context) {
 	} else {
 		bucket, err = cfs.BucketFromFile(bucketPath)
 		check(err)
+		// ハッシュの種類が変更された場合は、以前のアップロード結果を使わない
+		if bucket.HashType != cfs.Option.DefaultHashType() {
+			if cfs.Verbose {
+				fmt.Printf("hash type changed from %s to %s\n", bucket.HashType, cfs.Option.DefaultHashType())
+			}
+			bucket = cfs.NewBucket()
+			bucket.Path = bucketPath
+		}
 	}
 	bucket.Tag = c.String("tag")
 
@@ -200,8 +240,11 @@ func doUpload(c *cli.Context) {
 	check(err)
 
 	client := &cfs.Client{
-		Storage: storage,
-		Bucket:  bucket,
+		Storage:   storage,
+		Bucket:    bucket,
+		Ignore:    ignoreMatcherFromFlags(c),
+		ForceTag:  c.Bool("force"),
+		ExpectTag: c.String("expect"),
 	}
 
 	check(client.Init())
@@ -223,6 +266,25 @@ var syncCommand = cli.Command{
 	Usage:     "sync from cabinet",
 	Action:    doSync,
 	ArgsUsage: "location output-dir",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "jobs, j",
+			Value: cfs.DefaultDownloadWorker,
+			Usage: "number of parallel downloads",
+		},
+		cli.BoolFlag{
+			Name:  "delete",
+			Usage: "delete files not in the bucket from output-dir",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "pattern of files not to delete by --delete",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "don't sync, only show files to download (and to delete by --delete)",
+		},
+	},
 }
 
 func doSync(c *cli.Context) {
@@ -239,18 +301,38 @@ func doSync(c *cli.Context) {
 
 	downloader, err := cfs.NewDownloader(getDownloaderURL())
 	check(err)
+	downloader.MaxWorker = c.Int("jobs")
+	downloader.StatePath, err = cfs.SyncStatePath(dir)
+	check(err)
 
 	bucket, err := downloader.LoadBucket(location)
 	check(err)
 
-	filter := c.GlobalString("filter-cmd")
+	bucket, err = filterBucket(c, bucket)
+	check(err)
 
-	if filter != "" {
-		bucket, err = filterBucket(filter, bucket)
+	if c.Bool("dry-run") {
+		downloads, err := downloader.SyncPlan(bucket, dir)
 		check(err)
+		for _, path := range downloads {
+			fmt.Printf("download %s\n", path)
+		}
+		if c.Bool("delete") {
+			removed, err := cfs.RemoveUntracked(bucket, dir, c.StringSlice("exclude"), true)
+			check(err)
+			for _, path := range removed {
+				fmt.Printf("remove %s\n", path)
+			}
+		}
+		return
 	}
 
 	check(downloader.Sync(bucket, dir))
+
+	if c.Bool("delete") {
+		_, err := cfs.RemoveUntracked(bucket, dir, c.StringSlice("exclude"), false)
+		check(err)
+	}
 }
 
 var mergeCommand = cli.Command{
@@ -264,6 +346,8 @@ var mergeCommand = cli.Command{
 			Value: "",
 			Usage: "hash output file",
 		},
+		forceTagFlag,
+		expectTagFlag,
 	},
 }
 
@@ -284,27 +368,24 @@ func doMerge(c *cli.Context) {
 	downloader, err := cfs.NewDownloader(getDownloaderURL())
 	check(err)
 
-	merged := &cfs.Bucket{
-		Tag:      mergeTo,
-		Contents: make(map[string]cfs.Content),
-		HashType: "md5",
-	}
+	merged := cfs.NewBucket()
+	merged.Tag = mergeTo
 
-	for _, location := range mergeFrom {
+	for i, location := range mergeFrom {
 		bucket, err := downloader.LoadBucket(location)
 		check(err)
+		// ハッシュの種類は、最初のバケットに合わせる
+		if i == 0 {
+			merged.HashType = bucket.HashType
+		}
 		if cfs.Verbose {
 			fmt.Printf("%d files merged from %s\n", len(bucket.Contents), location)
 		}
 		merged.Merge(bucket)
 	}
 
-	filter := c.GlobalString("filter-cmd")
-
-	if filter != "" {
-		merged, err = filterBucket(filter, merged)
-		check(err)
-	}
+	merged, err = filterBucket(c, merged)
+	check(err)
 
 	if cfs.Verbose {
 		fmt.Printf("total %d files into %s\n", len(merged.Contents), mergeTo)
@@ -315,8 +396,10 @@ func doMerge(c *cli.Context) {
 	check(err)
 
 	client := &cfs.Client{
-		Storage: storage,
-		Bucket:  merged,
+		Storage:   storage,
+		Bucket:    merged,
+		ForceTag:  c.Bool("force"),
+		ExpectTag: c.String("expect"),
 	}
 
 	check(client.Init())
@@ -359,10 +442,8 @@ func doCat(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	data, err := downloader.Fetch(content.Hash, content.Attr)
+	err = downloader.FetchContentTo(content, os.Stdout)
 	check(err)
-
-	fmt.Print(string(data))
 }
 
 var lsCommand = cli.Command{
@@ -425,9 +506,10 @@ func doLs(c *cli.Context) {
 }
 
 var configCommand = cli.Command{
-	Name:   "config",
-	Usage:  "show current config",
-	Action: doConfig,
+	Name:      "config",
+	Usage:     "show current config",
+	Action:    doConfig,
+	ArgsUsage: "[path ...]",
 }
 
 func doConfig(c *cli.Context) {
@@ -435,6 +517,21 @@ func doConfig(c *cli.Context) {
 
 	fmt.Printf("Cabinet       : %s\n", cfs.Option.Cabinet)
 	fmt.Printf("Downloader URL: %s\n", getDownloaderURL())
+	fmt.Printf("Attribute     : %s\n", cfs.DefaultContentAttribute())
+	for i, rule := range cfs.Option.AttributeRules {
+		fmt.Printf("Rule[%d]       : %s\n", i, rule.String())
+	}
+
+	// パスが指定されたら、どのルールが適用されるかを表示する
+	bucket := cfs.NewBucket()
+	for _, path := range c.Args() {
+		i, rule := cfs.Option.FindAttributeRule(filepath.ToSlash(path))
+		ruleStr := "default"
+		if rule != nil {
+			ruleStr = fmt.Sprintf("Rule[%d] %s", i, rule.String())
+		}
+		fmt.Printf("%s\t%s\t%s\n", path, bucket.GetAttribute(path), ruleStr)
+	}
 }
 
 var settingCommand = cli.Command{
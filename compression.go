@@ -0,0 +1,182 @@
+package cfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec は圧縮の方式を表す
+// ContentAttribute の codecShift ビット目からに記録される
+type Codec int
+
+const (
+	// CodecZlib はzlibで圧縮する(以前からの形式)
+	CodecZlib Codec = 0
+	// CodecZstd はzstdで圧縮する
+	CodecZstd Codec = 1
+	// CodecLz4 はlz4で圧縮する
+	CodecLz4 Codec = 2
+)
+
+const codecShift = 4
+const codecMask = 0xf << codecShift
+
+var codecNames = map[Codec]string{
+	CodecZlib: "zlib",
+	CodecZstd: "zstd",
+	CodecLz4:  "lz4",
+}
+
+func (c Codec) String() string {
+	name, ok := codecNames[c]
+	if !ok {
+		return fmt.Sprintf("codec(%d)", int(c))
+	}
+	return name
+}
+
+// ParseCodec は、圧縮方式の名前からCodecを返す
+// 空文字列の場合は CodecZlib を返す
+func ParseCodec(name string) (Codec, error) {
+	if name == "" {
+		return CodecZlib, nil
+	}
+	for codec, codecName := range codecNames {
+		if name == codecName {
+			return codec, nil
+		}
+	}
+	return CodecZlib, fmt.Errorf("unknown codec '%s'", name)
+}
+
+// zstdのEncoder/Decoderは作成のコストが大きいため、一度だけ作成して共有する
+// EncodeAll/DecodeAll は並列に呼び出しても安全
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+var zstdErr error
+
+func zstdCoder() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// compress は、codecでdataを圧縮する
+func compress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecZlib:
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes(), nil
+	case CodecZstd:
+		encoder, _, err := zstdCoder()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, nil), nil
+	case CodecLz4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %v", codec)
+	}
+}
+
+// decompress は、codecで圧縮されたdataを展開する
+func decompress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecZlib:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readAll(r)
+	case CodecZstd:
+		_, decoder, err := zstdCoder()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	case CodecLz4:
+		return readAll(lz4.NewReader(bytes.NewReader(data)))
+	default:
+		return nil, fmt.Errorf("unknown codec %v", codec)
+	}
+}
+
+// adaptCompression は、 Option.AdaptiveCompress が設定されている場合に、
+// 圧縮してもサイズが Option.MinCompressRatio の割合以上小さくならないファイルを圧縮しない属性にする
+// Option.CompressSampleSize より大きいファイルは、先頭の一部だけを圧縮して判断する
+func adaptCompression(path string, data []byte, attr ContentAttribute) ContentAttribute {
+	if !Option.AdaptiveCompress || !attr.Compressed() {
+		return attr
+	}
+
+	sample := data
+	if Option.CompressSampleSize > 0 && len(sample) > Option.CompressSampleSize {
+		sample = sample[:Option.CompressSampleSize]
+	}
+
+	ratio := 0.0
+	if len(sample) > 0 {
+		compressed, err := compress(attr.Codec(), sample)
+		if err != nil {
+			// 判断できない場合は、そのまま圧縮する
+			return attr
+		}
+		ratio = 1 - float64(len(compressed))/float64(len(sample))
+	}
+
+	if ratio < Option.MinCompressRatio {
+		if Verbose {
+			fmt.Printf("store %s uncompressed, %.1f%% saved by %v\n", path, ratio*100, attr.Codec())
+		}
+		return attr &^ (Compressed | codecMask)
+	}
+	return attr
+}
+
+// detectCodec は、圧縮されたデータの先頭から圧縮方式を判定する
+func detectCodec(data []byte) Codec {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CodecZstd
+	case bytes.HasPrefix(data, []byte{0x04, 0x22, 0x4d, 0x18}):
+		return CodecLz4
+	default:
+		return CodecZlib
+	}
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	_, err := io.Copy(buf, r)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/go-yaml/yaml"
 )
@@ -15,16 +16,20 @@ type SettingInfo struct {
 var globalCacheDir string
 var globalDataCacheDir string
 var globalSettingPath string
+var globalDirMutex sync.Mutex // 並列にダウンロードするときにキャッシュディレクトリを同時に初期化しないためのロック
 var Setting *SettingInfo
 
 // CFSのキャッシュディレクトリを取得する
 // ~/.cfs/cache がなければ作成してそれを返す
 func GlobalCacheDir() string {
+	globalDirMutex.Lock()
+	defer globalDirMutex.Unlock()
+
 	if globalCacheDir != "" {
 		return globalCacheDir
 	}
 
-	globalCacheDir := filepath.Join(HomeDir(), "cache")
+	globalCacheDir = filepath.Join(HomeDir(), "cache")
 	_, err := os.Stat(globalCacheDir)
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(globalCacheDir, 0777)
@@ -38,11 +43,14 @@ func GlobalCacheDir() string {
 // CFSのデータキャッシュディレクトリを取得する
 // ~/.cfs/data がなければ作成してそれを返す
 func GlobalDataCacheDir() string {
+	globalDirMutex.Lock()
+	defer globalDirMutex.Unlock()
+
 	if globalDataCacheDir != "" {
 		return globalDataCacheDir
 	}
 
-	globalDataCacheDir := filepath.Join(HomeDir(), "datacache")
+	globalDataCacheDir = filepath.Join(HomeDir(), "datacache")
 	_, err := os.Stat(globalDataCacheDir)
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(globalDataCacheDir, 0777)
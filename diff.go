@@ -0,0 +1,198 @@
+package cfs
+
+import (
+	"sort"
+)
+
+// DiffEntry は、二つのバケットの間で変更された一つのファイルを表す
+type DiffEntry struct {
+	Path    string   // ファイルのパス(名前を変更した場合は新しいパス)
+	OldPath string   `json:",omitempty"` // 名前を変更した場合の古いパス
+	Old     *Content `json:",omitempty"` // 古いバケットのファイル(追加された場合はnil)
+	New     *Content `json:",omitempty"` // 新しいバケットのファイル(削除された場合はnil)
+}
+
+// BucketDiff は、二つのバケットの差分を表す
+type BucketDiff struct {
+	Added    []DiffEntry
+	Removed  []DiffEntry
+	Modified []DiffEntry
+	Renamed  []DiffEntry // 内容(OrigHash)が同じで、パスだけが変わったファイル
+
+	oldHashes  map[string]bool // 古いバケットのデータのハッシュ(ダウンロードするサイズの計算に使う)
+	oldChunked []Content       // 古いバケットの分割されたファイル(ダウンロードするサイズの計算に使う)
+}
+
+// ChunkLoader は、分割されたファイルのチャンクリストを取得する( Downloader が実装する)
+type ChunkLoader interface {
+	LoadChunkList(c Content) ([]Chunk, error)
+}
+
+// DiffSummary は、バケットの差分の集計を表す
+type DiffSummary struct {
+	Added         int
+	Removed       int
+	Modified      int
+	Renamed       int
+	AddedBytes    int64 // 追加されたファイルの元のサイズの合計
+	RemovedBytes  int64 // 削除されたファイルの元のサイズの合計
+	ModifiedBytes int64 // 変更されたファイルの、変更後の元のサイズの合計
+	DownloadBytes int64 // 古いバケットを同期したクライアントが、新たにダウンロードするデータのサイズ
+}
+
+// Diff は、bからotherへの差分を返す
+// 内容(OrigHash)が変わっていないファイルは、圧縮や暗号化の方法が変わっていても、変更されたものとしない
+// 削除されたファイルと同じ内容のファイルが追加された場合は、名前を変更したものとする
+func (b *Bucket) Diff(other *Bucket) *BucketDiff {
+	d := &BucketDiff{
+		Added:    []DiffEntry{},
+		Removed:  []DiffEntry{},
+		Modified: []DiffEntry{},
+		Renamed:  []DiffEntry{},
+	}
+
+	added := []Content{}
+	for _, path := range sortedPaths(other) {
+		c := other.Contents[path]
+		old, ok := b.Contents[path]
+		if !ok {
+			added = append(added, c)
+		} else if old.OrigHash != c.OrigHash {
+			d.Modified = append(d.Modified, DiffEntry{Path: path, Old: &old, New: &c})
+		}
+	}
+
+	// 削除されたファイルを、内容ごとにまとめる
+	removed := map[string][]Content{}
+	for _, path := range sortedPaths(b) {
+		if _, ok := other.Contents[path]; !ok {
+			c := b.Contents[path]
+			removed[c.OrigHash] = append(removed[c.OrigHash], c)
+		}
+	}
+
+	for i := range added {
+		c := added[i]
+		if olds := removed[c.OrigHash]; len(olds) > 0 {
+			old := olds[0]
+			removed[c.OrigHash] = olds[1:]
+			d.Renamed = append(d.Renamed, DiffEntry{Path: c.Path, OldPath: old.Path, Old: &old, New: &c})
+		} else {
+			d.Added = append(d.Added, DiffEntry{Path: c.Path, New: &c})
+		}
+	}
+
+	for _, olds := range removed {
+		for i := range olds {
+			old := olds[i]
+			d.Removed = append(d.Removed, DiffEntry{Path: old.Path, Old: &old})
+		}
+	}
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Path < d.Removed[j].Path })
+
+	d.oldHashes = map[string]bool{}
+	for _, c := range b.Contents {
+		d.oldHashes[c.Hash] = true
+		if c.Attr.Chunked() {
+			d.oldChunked = append(d.oldChunked, c)
+		}
+	}
+
+	return d
+}
+
+// IsEmpty は、差分がないかどうかを返す
+func (d *BucketDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0 && len(d.Renamed) == 0
+}
+
+// Summary は、差分を集計する
+// ダウンロードするサイズは、古いバケットにない(ハッシュの)データの、保存されているサイズの合計
+// 分割されたファイルは、チャンクリストと、古いバケットにないチャンクだけを数えるため、loaderでチャンクリストを取得する
+func (d *BucketDiff) Summary(loader ChunkLoader) (DiffSummary, error) {
+	s := DiffSummary{
+		Added:    len(d.Added),
+		Removed:  len(d.Removed),
+		Modified: len(d.Modified),
+		Renamed:  len(d.Renamed),
+	}
+
+	for _, e := range d.Added {
+		s.AddedBytes += int64(e.New.OrigSize)
+	}
+	for _, e := range d.Removed {
+		s.RemovedBytes += int64(e.Old.OrigSize)
+	}
+	for _, e := range d.Modified {
+		s.ModifiedBytes += int64(e.New.OrigSize)
+	}
+
+	// 古いバケットのチャンクは、分割されたファイルをダウンロードする場合にだけ取得する
+	old := d.oldHashes
+	oldChunksLoaded := false
+	downloaded := map[string]bool{}
+	for _, entries := range [][]DiffEntry{d.Added, d.Modified, d.Renamed} {
+		for _, e := range entries {
+			if old[e.New.Hash] || downloaded[e.New.Hash] {
+				continue
+			}
+			downloaded[e.New.Hash] = true
+			if !e.New.Attr.Chunked() {
+				s.DownloadBytes += int64(e.New.Size)
+				continue
+			}
+
+			if !oldChunksLoaded {
+				var err error
+				old, err = d.withOldChunks(loader)
+				if err != nil {
+					return DiffSummary{}, err
+				}
+				oldChunksLoaded = true
+			}
+			chunks, err := loader.LoadChunkList(*e.New)
+			if err != nil {
+				return DiffSummary{}, err
+			}
+			// Size は、チャンクリストと全てのチャンクのサイズの合計なので、チャンクのサイズを引くとチャンクリストのサイズになる
+			s.DownloadBytes += int64(e.New.Size)
+			for _, chunk := range chunks {
+				s.DownloadBytes -= int64(chunk.Size)
+				if !old[chunk.Hash] && !downloaded[chunk.Hash] {
+					downloaded[chunk.Hash] = true
+					s.DownloadBytes += int64(chunk.Size)
+				}
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// withOldChunks は、古いバケットのデータのハッシュに、分割されたファイルのチャンクのハッシュを加えたものを返す
+func (d *BucketDiff) withOldChunks(loader ChunkLoader) (map[string]bool, error) {
+	hashes := make(map[string]bool, len(d.oldHashes))
+	for hash := range d.oldHashes {
+		hashes[hash] = true
+	}
+	for _, c := range d.oldChunked {
+		chunks, err := loader.LoadChunkList(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			hashes[chunk.Hash] = true
+		}
+	}
+	return hashes, nil
+}
+
+// sortedPaths は、バケットのファイルのパスをソートして返す
+func sortedPaths(b *Bucket) []string {
+	paths := make([]string, 0, len(b.Contents))
+	for path := range b.Contents {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
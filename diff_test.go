@@ -0,0 +1,80 @@
+package cfs
+
+import (
+	"testing"
+)
+
+func TestBucketDiff(t *testing.T) {
+	content := func(path string, hash string, origHash string, size int) Content {
+		return Content{Path: path, Hash: hash, OrigHash: origHash, Size: size, OrigSize: size * 2}
+	}
+
+	old := NewBucket()
+	for _, c := range []Content{
+		content("same", "h1", "o1", 1),
+		content("modified", "h2", "o2", 2),
+		content("removed", "h3", "o3", 3),
+		content("renamed", "h4", "o4", 4),
+		content("recompressed", "h5", "o5", 5),
+	} {
+		old.Contents[c.Path] = c
+	}
+
+	cur := NewBucket()
+	for _, c := range []Content{
+		content("same", "h1", "o1", 1),
+		content("modified", "h6", "o6", 6),
+		content("added", "h7", "o7", 7),
+		content("added2", "h7", "o7", 7),
+		content("copied", "h1", "o1", 1),
+		content("renamed2", "h4", "o4", 4),
+		content("recompressed", "h8", "o5", 8),
+	} {
+		cur.Contents[c.Path] = c
+	}
+
+	d := old.Diff(cur)
+	paths := func(entries []DiffEntry) []string {
+		r := []string{}
+		for _, e := range entries {
+			r = append(r, e.OldPath+":"+e.Path)
+		}
+		return r
+	}
+	for name, pair := range map[string][2]interface{}{
+		"added":    {paths(d.Added), []string{":added", ":added2", ":copied"}},
+		"removed":  {paths(d.Removed), []string{":removed"}},
+		"modified": {paths(d.Modified), []string{":modified"}},
+		"renamed":  {paths(d.Renamed), []string{"renamed:renamed2"}},
+	} {
+		actual, expected := pair[0].([]string), pair[1].([]string)
+		if len(actual) != len(expected) {
+			t.Errorf("%s must be %v, but %v", name, expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != expected[i] {
+				t.Errorf("%s must be %v, but %v", name, expected, actual)
+				break
+			}
+		}
+	}
+
+	s, err := d.Summary(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DiffSummary{
+		Added: 3, Removed: 1, Modified: 1, Renamed: 1,
+		AddedBytes: 30, RemovedBytes: 6, ModifiedBytes: 12,
+		// 古いバケットにあるデータと、同じデータの2回目はダウンロードしない
+		DownloadBytes: 6 + 7,
+	}
+	if s != expected {
+		t.Errorf("summary must be %+v, but %+v", expected, s)
+	}
+
+	if !old.Diff(old).IsEmpty() {
+		t.Errorf("diff of same bucket must be empty")
+	}
+}
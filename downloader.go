@@ -3,20 +3,30 @@ package cfs
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/natefinch/atomic"
-	"golang.org/x/sync/errgroup"
+	"github.com/pkg/errors"
 )
 
+// DefaultDownloadWorker は、並列にダウンロードする数のデフォルト値
+const DefaultDownloadWorker = 8
+
 type Downloader struct {
-	BaseUrl *url.URL
+	BaseUrl   *url.URL
+	MaxWorker int          // 並列にダウンロードする数(0なら DefaultDownloadWorker)
+	Retry     *RetryPolicy // nilなら Option.RetryPolicy() を使う
+	StatePath string       // Syncの状態を保存するファイルのパス(空なら保存せず、毎回全てのファイルを書き込む)
 }
 
 func NewDownloader(baseRawurl string) (*Downloader, error) {
@@ -34,24 +44,25 @@ func NewDownloader(baseRawurl string) (*Downloader, error) {
 
 func (d *Downloader) LoadBucket(location string) (*Bucket, error) {
 
-	b := &Bucket{
-		Contents: make(map[string]Content),
-		HashType: "md5",
-	}
+	b := NewBucket()
 
-	var body []byte
 	if !isHash(location) {
 		locationBytes, err := d.FetchTag(location)
 		if err != nil {
 			return nil, err
 		}
-		location = string(locationBytes)
+		location = strings.TrimSpace(string(locationBytes))
 		if !isHash(location) {
 			return nil, fmt.Errorf("%s is not hash", location)
 		}
 	}
 
-	body, err := d.Fetch(location, DefaultContentAttribute())
+	data, err := d.Fetch(location, NoContentAttribute)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := decodeBucket(data)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +71,7 @@ func (d *Downloader) LoadBucket(location string) (*Bucket, error) {
 	if err != nil {
 		return nil, err
 	}
+	b.Hash = location
 
 	return b, nil
 }
@@ -108,128 +120,463 @@ func (d *Downloader) ExistsAll(b *Bucket) (map[string]bool, error) {
 	return result, nil
 }
 
+// Sync は、バケットの全てのファイルをdirに書き込む
+// StatePath が設定されている場合は、前回のSync時から変更されていないファイルは書き込まない
 func (d *Downloader) Sync(b *Bucket, dir string) error {
-	for _, c := range b.Contents {
+	state, err := d.loadSyncState()
+	if err != nil {
+		return err
+	}
+
+	mutex := sync.Mutex{}
+	newState := &Bucket{Path: d.StatePath, Contents: make(map[string]Content), HashType: b.HashType}
+	skipped := 0
+
+	err = d.forEachContent(b, func(c Content) error {
+		fullPath := filepath.Join(dir, filepath.FromSlash(c.Path))
+
+		if old, ok := state.Contents[c.Path]; ok && isUpToDate(fullPath, old, c) {
+			mutex.Lock()
+			newState.Contents[c.Path] = old
+			skipped++
+			mutex.Unlock()
+			return nil
+		}
+
 		if Verbose {
 			fmt.Printf("downloading %s\n", c.Path)
 		}
 
+		err := os.MkdirAll(filepath.Dir(fullPath), 0777)
+		if err != nil {
+			return err
+		}
+
 		// TODO: 0 bytesのファイルはアップロードがされていないため、空ファイルを作る
-		var err error
-		data := []byte{}
 		if c.Size > 0 {
-			data, err = d.Fetch(c.Hash, c.Attr)
-			if err != nil {
-				return err
-			}
+			err = d.fetchToFile(c, fullPath)
+		} else {
+			err = atomic.WriteFile(fullPath, bytes.NewBuffer(nil))
 		}
-
-		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, filepath.FromSlash(c.Path))), 0777)
 		if err != nil {
 			return err
 		}
 
-		err = atomic.WriteFile(filepath.Join(dir, filepath.FromSlash(c.Path)), bytes.NewBuffer(data))
+		info, err := os.Stat(fullPath)
 		if err != nil {
 			return err
 		}
+
+		mutex.Lock()
+		newState.Contents[c.Path] = Content{
+			Path:     c.Path,
+			Hash:     c.Hash,
+			Size:     c.Size,
+			Time:     info.ModTime(),
+			OrigHash: c.OrigHash,
+			OrigSize: int(info.Size()),
+			Attr:     c.Attr,
+		}
+		mutex.Unlock()
+		return nil
+	})
+
+	if Verbose && d.StatePath != "" {
+		fmt.Printf("%d files are up to date\n", skipped)
+	}
+
+	// 途中で失敗しても、書き込めたファイルの状態は保存しておく
+	saveErr := d.saveSyncState(newState)
+	if err != nil {
+		return err
+	}
+	return saveErr
+}
+
+// SyncStatePath は、dirにSyncしたときの状態を保存するファイルのパスを返す
+func SyncStatePath(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(GlobalCacheDir(), fmt.Sprintf("sync-%x", md5.Sum([]byte(absDir)))), nil
+}
+
+// loadSyncState は、前回のSync時の状態を読み込む
+// 状態は、ファイルのパス、書き込んだ時刻、サイズ、OrigHashを持ったバケットとして保存されている
+func (d *Downloader) loadSyncState() (*Bucket, error) {
+	if d.StatePath == "" || Option.NoCache {
+		return NewBucket(), nil
+	}
+	return BucketFromFile(d.StatePath)
+}
+
+func (d *Downloader) saveSyncState(state *Bucket) error {
+	if d.StatePath == "" {
+		return nil
+	}
+
+	err := ioutil.WriteFile(filepath.FromSlash(d.StatePath), []byte(state.Dump()), 0666)
+	if err != nil {
+		return err
+	}
+	if Verbose {
+		fmt.Printf("write sync state to '%s'\n", d.StatePath)
 	}
 	return nil
 }
 
+// SyncPlan は、Sync(b, dir) を行った場合に書き込まれるファイルのパスを返す
+func (d *Downloader) SyncPlan(b *Bucket, dir string) ([]string, error) {
+	state, err := d.loadSyncState()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, c := range b.Contents {
+		fullPath := filepath.Join(dir, filepath.FromSlash(c.Path))
+		if old, ok := state.Contents[c.Path]; ok && isUpToDate(fullPath, old, c) {
+			continue
+		}
+		paths = append(paths, c.Path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// isUpToDate は、ローカルのファイルがすでに c と同じ内容で、書き込む必要がないかどうかを返す
+func isUpToDate(fullPath string, state Content, c Content) bool {
+	return state.OrigHash == c.OrigHash && isSyncedFile(fullPath, state)
+}
+
+// isSyncedFile は、ローカルのファイルが前回のSync時から変更されていないかどうかを返す
+func isSyncedFile(fullPath string, state Content) bool {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return false
+	}
+	// 保存される時刻は秒単位なので、秒単位で比較する
+	return info.Mode().IsRegular() && info.Size() == int64(state.OrigSize) && info.ModTime().Unix() == state.Time.Unix()
+}
+
 func (d *Downloader) FetchAll(b *Bucket) error {
-	const RETRY_LIMIT = 3
-	limit := make(chan struct{}, 8)
-	eg, ctx := errgroup.WithContext(context.Background())
-	ctx, cancel := context.WithCancel(ctx)
+	return d.forEachContent(b, func(c Content) error {
+		if Verbose {
+			fmt.Printf("downloading %s\n", c.Path)
+		}
 
+		// TODO: 0 bytesのファイルはアップロードがされていないため、空ファイルを作る
+		if c.Size == 0 {
+			os.Create(filepath.Join(GlobalDataCacheDir(), c.Hash))
+			return nil
+		}
+
+		return d.fetchWithRetry(c, ioutil.Discard)
+	})
+}
+
+// forEachContent は、バケットの全てのファイルに対して、fnを MaxWorker 並列で実行する
+// エラーが起きた場合は、まだ始まっていない処理をキャンセルし、
+// 失敗したファイルのうちパス順で最初のもののエラーを返す
+func (d *Downloader) forEachContent(b *Bucket, fn func(c Content) error) error {
+	maxWorker := d.MaxWorker
+	if maxWorker <= 0 {
+		maxWorker = DefaultDownloadWorker
+	}
+
+	contents := make([]Content, 0, len(b.Contents))
 	for _, c := range b.Contents {
-		c := c
-		eg.Go(func() error {
-			limit <- struct{}{}
-			defer func() { <-limit }()
-
-			select {
-			case <-ctx.Done():
-				return nil
-			default:
-				if Verbose {
-					fmt.Printf("downloading %s\n", c.Path)
-				}
+		contents = append(contents, c)
+	}
+	sort.Slice(contents, func(i, j int) bool { return contents[i].Path < contents[j].Path })
 
-				// TODO: 0 bytesのファイルはアップロードがされていないため、空ファイルを作る
-				if c.Size == 0 {
-					os.Create(filepath.Join(GlobalDataCacheDir(), c.Hash))
-					return nil
-				}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-				retryCount := 0
-				for {
-					_, err := d.Fetch(c.Hash, c.Attr)
-					if err != nil {
-						if retryCount < RETRY_LIMIT {
-							retryCount++
-							fmt.Printf("retry for %v, retry count %d\n", err, retryCount)
-							continue
-						} else {
-							return err
-						}
-					} else {
-						break
-					}
+	mutex := sync.Mutex{}
+	errs := map[string]error{}
+
+	wg := sync.WaitGroup{}
+	ch := make(chan Content)
+	for i := 0; i < maxWorker; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range ch {
+				if ctx.Err() != nil {
+					continue
 				}
+				err := fn(c)
+				if err != nil {
+					mutex.Lock()
+					errs[c.Path] = err
+					mutex.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+
+	for _, c := range contents {
+		ch <- c
+	}
+	close(ch)
+	wg.Wait()
 
+	if len(errs) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(errs))
+	for path := range errs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	if len(paths) == 1 {
+		return errors.Wrapf(errs[paths[0]], "cannot download '%s'", paths[0])
+	}
+	return errors.Wrapf(errs[paths[0]], "cannot download '%s' and %d other files", paths[0], len(paths)-1)
+}
+
+func (d *Downloader) retryPolicy() RetryPolicy {
+	if d.Retry != nil {
+		return *d.Retry
+	}
+	return Option.RetryPolicy()
+}
+
+// fetchWithRetry は、一時的なエラーならリトライしながらファイルをダウンロードしてwに書き込む
+// wが *os.File なら、リトライの前に先頭に戻って書き込み直す
+func (d *Downloader) fetchWithRetry(c Content, w io.Writer) error {
+	_, err := d.retryPolicy().Do(fmt.Sprintf("downloading '%s'", c.Path), isRetryableFetchError, func() error {
+		if f, ok := w.(*os.File); ok {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
 			}
-			return nil
-		})
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+		}
+		return d.FetchContentTo(c, w)
+	})
+	return err
+}
+
+// fetchToFile は、ファイルをダウンロードして、復号化/展開しながらfullPathに書き込む
+// 一時ファイルに書き込んでから置き換えるので、失敗しても中途半端なファイルは残らない
+func (d *Downloader) fetchToFile(c Content, fullPath string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fullPath), ".cfs-")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmp.Name())
 
-	err := eg.Wait()
-	cancel()
+	err = d.fetchWithRetry(c, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// 元のファイルがあれば、そのパーミッションを引き継ぐ
+	if info, err := os.Stat(fullPath); err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode())
+		if err != nil {
+			return err
+		}
+	}
+
+	return atomic.ReplaceFile(tmp.Name(), fullPath)
 }
 
+// Fetch は、ハッシュを指定してデータを取得し、復号化/展開したものを返す
+// 取得したデータがハッシュと一致しない場合は、一度だけダウンロードし直す
 func (d *Downloader) Fetch(hash string, attr ContentAttribute) ([]byte, error) {
+	var buf bytes.Buffer
+	err := d.FetchTo(hash, attr, &buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FetchContent は、Contentのデータを取得し、復号化/展開したものを返す
+// Fetch と違い、復号化/展開したデータも OrigHash と一致するかを確認する
+func (d *Downloader) FetchContent(c Content) ([]byte, error) {
+	var buf bytes.Buffer
+	err := d.FetchContentTo(c, &buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FetchTo は、ハッシュを指定してデータを取得し、復号化/展開しながらwに書き込む
+// データはキャッシュファイルに書き込んでハッシュを確認してから読み出すので、
+// 全体をメモリに読み込むことはない(AES-GCMで暗号化されたデータを除く)
+func (d *Downloader) FetchTo(hash string, attr ContentAttribute, w io.Writer) error {
+	return d.fetchTo(hash, attr, "", w)
+}
+
+// FetchContentTo は、Contentのデータを取得し、復号化/展開しながらwに書き込む
+// 復号化/展開したデータが OrigHash と一致しない場合は、wに書き込んだ後で *IntegrityError を返すので、
+// エラーの場合はwに書き込まれた内容を使ってはいけない
+func (d *Downloader) FetchContentTo(c Content, w io.Writer) error {
+	return d.fetchTo(c.Hash, c.Attr, c.OrigHash, w)
+}
+
+// fetchTo は、データをキャッシュに取得して、復号化/展開しながらwに書き込む
+// origHashが空なら、復号化/展開後のデータは確認しない
+func (d *Downloader) fetchTo(hash string, attr ContentAttribute, origHash string, w io.Writer) error {
 	if !isHash(hash) {
-		return nil, fmt.Errorf("cannot fetch data, %s is not a hash", hash)
+		return fmt.Errorf("cannot fetch data, %s is not a hash", hash)
 	}
 
-	var data []byte
+	if origHash == "" {
+		return d.fetchDecoded(hash, attr, w)
+	}
+
+	h := newHashLike(origHash)
+	err := d.fetchDecoded(hash, attr, io.MultiWriter(w, h))
+	if err != nil {
+		return err
+	}
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != origHash {
+		return &IntegrityError{Hash: hash, Expected: origHash, Actual: actual, Decoded: true}
+	}
+	return nil
+}
+
+// fetchDecoded は、データをキャッシュに取得して、復号化/展開しながらwに書き込む
+// 分割して保存されたデータは、全てのチャンクをつなげて書き込む
+func (d *Downloader) fetchDecoded(hash string, attr ContentAttribute, w io.Writer) error {
+	if attr.Chunked() {
+		return d.fetchChunkedTo(hash, attr, w)
+	}
+
+	cache, err := d.fetchCache(hash)
+	if err != nil {
+		return err
+	}
 
+	f, err := os.Open(cache)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return decodeStream(w, f, attr)
+}
+
+// fetchCache は、データをキャッシュファイルに取得して、そのパスを返す
+// キャッシュが壊れていた場合はダウンロードし直し、ダウンロードしたデータが壊れていた場合は一度だけダウンロードし直す
+func (d *Downloader) fetchCache(hash string) (string, error) {
 	// データをキャッシュしているパス取得
 	cache := filepath.Join(GlobalDataCacheDir(), hash)
-	_, err := os.Stat(cache)
-	if !os.IsNotExist(err) {
-		data, err = ioutil.ReadFile(cache)
-		if err != nil {
-			return nil, err
-		}
-	} else {
 
-		// ダウンロードURL取得
-		fetchUrl, err := d.dataUrl(hash)
-		if err != nil {
-			return nil, err
+	actual, err := sumFileLike(hash, cache)
+	if err == nil {
+		if actual == hash {
+			return cache, nil
 		}
-
-		// ファイルダウンロード
-		data, err = fetch(fetchUrl)
-		if err != nil {
-			return nil, err
+		// 壊れたデータはキャッシュから削除する
+		os.Remove(cache)
+		if Verbose {
+			fmt.Printf("download %s again, %v\n", hash, &IntegrityError{Hash: hash, Expected: hash, Actual: actual})
 		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
 
-		// データファイルをキャッシュする
-		err = atomic.WriteFile(cache, bytes.NewBuffer(data))
+	for retried := false; ; retried = true {
+		err := d.downloadToCache(hash, cache)
+		if _, ok := err.(*IntegrityError); ok && !retried {
+			if Verbose {
+				fmt.Printf("download %s again, %v\n", hash, err)
+			}
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return "", err
 		}
+		return cache, nil
+	}
+}
+
+// downloadToCache は、データをダウンロードしながらハッシュを計算し、一致した場合だけキャッシュファイルにする
+func (d *Downloader) downloadToCache(hash string, cache string) error {
+	// ダウンロードURL取得
+	fetchUrl, err := d.dataUrl(hash)
+	if err != nil {
+		return err
+	}
+
+	res, err := getRequest(fetchUrl)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return &statusError{StatusCode: res.StatusCode, Url: fetchUrl}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(cache), ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := newHashLike(hash)
+	_, err = io.Copy(io.MultiWriter(tmp, h), res.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != hash {
+		return &IntegrityError{Hash: hash, Expected: hash, Actual: actual}
+	}
+
+	// 確認できたデータファイルだけをキャッシュする
+	return atomic.ReplaceFile(tmp.Name(), cache)
+}
+
+// sumFileLike は、hashと同じ種類のハッシュ関数でファイルのハッシュを計算する
+func sumFileLike(hash string, file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	return decode(data, Option.EncryptKey, Option.EncryptIv, attr)
+	h := newHashLike(hash)
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// IntegrityError は、取得したデータがハッシュと一致しないことを表す
+type IntegrityError struct {
+	Hash     string // 取得しようとしたデータのハッシュ
+	Expected string // 期待したハッシュ
+	Actual   string // 実際のハッシュ
+	Decoded  bool   // 復号化/展開後のデータの確認で失敗したかどうか
+}
+
+func (e *IntegrityError) Error() string {
+	target := "data"
+	if e.Decoded {
+		target = "decoded data"
+	}
+	return fmt.Sprintf("integrity check failed for %s, %s hash must be %s but %s", e.Hash, target, e.Expected, e.Actual)
 }
 
 func (d *Downloader) FetchTag(tag string) ([]byte, error) {
@@ -273,12 +620,12 @@ func fetch(_url *url.URL) ([]byte, error) {
 		return nil, err
 	}
 
+	defer res.Body.Close()
+
 	if res.StatusCode >= 400 {
-		return nil, fmt.Errorf("bad response status code %d from %v", res.StatusCode, _url)
+		return nil, &statusError{StatusCode: res.StatusCode, Url: _url}
 	}
 
-	defer res.Body.Close()
-
 	contents, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
@@ -286,3 +633,24 @@ func fetch(_url *url.URL) ([]byte, error) {
 
 	return contents, nil
 }
+
+// statusError は、HTTPのレスポンスがエラーだったことを表す
+type statusError struct {
+	StatusCode int
+	Url        *url.URL
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad response status code %d from %v", e.StatusCode, e.Url)
+}
+
+// isRetryableFetchError は、ダウンロードのエラーがリトライで成功する可能性があるかどうかを返す
+// サーバーエラー(5xx/429)と一時的なネットワークエラーのみリトライする
+// IntegrityError は Fetch の中で再ダウンロードしているので、リトライしない
+func isRetryableFetchError(err error) bool {
+	err = errors.Cause(err)
+	if e, ok := err.(*statusError); ok {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return isTemporaryError(err)
+}
@@ -0,0 +1,277 @@
+package cfs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	c, b, dir := setupBucketWithFiles()
+	addFile(dir, "empty", "")
+
+	c.AddFiles(dir)
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+	d.MaxWorker = 2
+
+	out, err := ioutil.TempDir("", "cfs-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Sync(b2, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{"hoge": "hoge", "fuga": "fuga", "piyo/piyo": "piyo", "empty": ""} {
+		data, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(path)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(data) != expected {
+			t.Errorf("%s must be '%s' but '%s'", path, expected, data)
+		}
+	}
+}
+
+func TestSyncWithError(t *testing.T) {
+	c, b, _ := setupBucketWithFiles()
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+	d.Retry = &NoRetry
+	d.MaxWorker = 1
+
+	// 存在しないデータを参照させる
+	for _, path := range []string{"b", "a", "c"} {
+		b2.Contents[path] = Content{Path: path, Hash: b.Sum([]byte("missing " + path)), Size: 1}
+	}
+
+	out, err := ioutil.TempDir("", "cfs-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Sync(b2, out)
+	if err == nil {
+		t.Fatal("sync must fail")
+	}
+	if !strings.HasPrefix(err.Error(), "cannot download 'a'") {
+		t.Errorf("the first failed file must be reported, but %v", err)
+	}
+}
+
+func TestRemoveUntracked(t *testing.T) {
+	b := NewBucket()
+	b.Contents["hoge"] = Content{Path: "hoge"}
+	b.Contents["piyo/piyo"] = Content{Path: "piyo/piyo"}
+
+	dir, err := ioutil.TempDir("", "cfs-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addFile(dir, "hoge", "hoge")
+	addFile(dir, "fuga", "fuga")
+	addFile(dir, "piyo/piyo", "piyo")
+	addFile(dir, "piyo/old", "old")
+	addFile(dir, "old/old", "old")
+	addFile(dir, "local.txt", "local")
+	addFile(dir, "keep/keep", "keep")
+
+	excludes := []string{"*.txt", "keep"}
+	expected := "fuga,old/,old/old,piyo/old"
+
+	removed, err := RemoveUntracked(b, dir, excludes, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(removed, ",") != expected {
+		t.Errorf("invalid dry-run result %v", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "fuga")); err != nil {
+		t.Errorf("dry-run must not remove files")
+	}
+
+	removed, err = RemoveUntracked(b, dir, excludes, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(removed, ",") != expected {
+		t.Errorf("invalid result %v", removed)
+	}
+	for _, path := range []string{"fuga", "old", "piyo/old"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path))); !os.IsNotExist(err) {
+			t.Errorf("%s must be removed", path)
+		}
+	}
+	for _, path := range []string{"hoge", "piyo/piyo", "local.txt", "keep/keep"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path))); err != nil {
+			t.Errorf("%s must not be removed", path)
+		}
+	}
+}
+
+func TestIncrementalSync(t *testing.T) {
+	c, b, _ := setupBucketWithFiles()
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+
+	out, err := ioutil.TempDir("", "cfs-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.StatePath = filepath.Join(out, ".state")
+
+	err = d.Sync(b2, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fuga := filepath.Join(out, "fuga")
+	info, err := os.Stat(fuga)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ローカルで変更されたファイルだけ書き直される
+	addFile(out, "hoge", "modified")
+
+	plan, err := d.SyncPlan(b2, out)
+	if err != nil || len(plan) != 1 || plan[0] != "hoge" {
+		t.Errorf("only modified file must be planned, but %v %v", plan, err)
+	}
+
+	err = d.Sync(b2, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(out, "hoge"))
+	if err != nil || string(data) != "hoge" {
+		t.Errorf("modified file must be synced, but '%s' %v", data, err)
+	}
+
+	info2, err := os.Stat(fuga)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(info2.ModTime()) {
+		t.Errorf("unchanged file must not be written")
+	}
+}
+
+func TestFetchIntegrity(t *testing.T) {
+	c, b, dir := setupBucket()
+	addFile(dir, "hoge", "integrity")
+	c.AddFiles(dir)
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+	content := b2.Contents["hoge"]
+
+	// 壊れたキャッシュは、ダウンロードし直される
+	cache := filepath.Join(GlobalDataCacheDir(), content.Hash)
+	err = ioutil.WriteFile(cache, []byte("broken"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := d.FetchContent(content)
+	if err != nil || string(data) != "integrity" {
+		t.Errorf("broken cache must be downloaded again, but '%s' %v", data, err)
+	}
+
+	// キャビネットのデータも壊れている場合は、エラーになる
+	os.Remove(cache)
+	path := "data/" + hashPath(content.Hash)
+	err = c.Storage.Delete(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Storage.Upload("hoge", content.Hash, []byte("broken"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.FetchContent(content)
+	if _, ok := err.(*IntegrityError); !ok {
+		t.Errorf("broken data must be IntegrityError, but %v", err)
+	}
+	if _, err := os.Stat(cache); !os.IsNotExist(err) {
+		t.Errorf("broken data must not be cached")
+	}
+}
+
+func TestFetchTo(t *testing.T) {
+	c, b, dir := setupBucket()
+	content := strings.Repeat("fetch to writer\n", 1000)
+	addFile(dir, "hoge", content)
+	c.AddFiles(dir)
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+	hoge := b2.Contents["hoge"]
+
+	var buf strings.Builder
+	err = d.FetchContentTo(hoge, &buf)
+	if err != nil || buf.String() != content {
+		t.Errorf("cannot fetch to writer, %v", err)
+	}
+
+	// キャッシュから読み込んでも同じ
+	buf.Reset()
+	err = d.FetchTo(hoge.Hash, hoge.Attr, &buf)
+	if err != nil || buf.String() != content {
+		t.Errorf("cannot fetch from cache, %v", err)
+	}
+
+	// 展開したデータが OrigHash と一致しない場合はエラー
+	hoge.OrigHash = sumLike(hoge.OrigHash, []byte("other"))
+	err = d.FetchContentTo(hoge, ioutil.Discard)
+	if e, ok := err.(*IntegrityError); !ok || !e.Decoded {
+		t.Errorf("decoded data must be IntegrityError, but %v", err)
+	}
+}
+
+func TestIsRetryableFetchError(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{&statusError{StatusCode: 503}, true},
+		{&statusError{StatusCode: 429}, true},
+		{&statusError{StatusCode: 403}, false},
+		{io.ErrUnexpectedEOF, true},
+		{&IntegrityError{}, false},
+		{errors.New("unknown"), false},
+	}
+	for _, c := range cases {
+		if r := isRetryableFetchError(c.err); r != c.retryable {
+			t.Errorf("isRetryableFetchError(%v) must be %v, but %v", c.err, c.retryable, r)
+		}
+	}
+}
@@ -2,7 +2,14 @@ package cfs
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 type DummyStorage struct {
@@ -10,6 +17,8 @@ type DummyStorage struct {
 	rootUrl     *url.URL
 	contents    map[string][]byte
 	tags        map[string][]byte
+	histories   map[string][]byte
+	modTimes    map[string]time.Time
 
 	onUpload func(filename string, hash string, body []byte, overwrite bool) error
 }
@@ -19,6 +28,8 @@ func NewDummyStorage(cabinetPath string) (*DummyStorage, error) {
 		CabinetPath: cabinetPath,
 		contents:    make(map[string][]byte),
 		tags:        make(map[string][]byte),
+		histories:   make(map[string][]byte),
+		modTimes:    make(map[string]time.Time),
 	}
 
 	return s, nil
@@ -41,6 +52,7 @@ func (s *DummyStorage) Upload(filename string, hash string, body []byte, overwri
 	}
 
 	s.contents[hash] = body
+	s.modTimes["data/"+hashPath(hash)] = time.Now()
 
 	if Verbose {
 		fmt.Printf("uploading '%s' as '%s'\n", filename, hash)
@@ -49,8 +61,25 @@ func (s *DummyStorage) Upload(filename string, hash string, body []byte, overwri
 	return nil
 }
 
-func (s *DummyStorage) UploadTag(filename string, body []byte) error {
+func (s *DummyStorage) UploadReader(filename string, hash string, r io.Reader, size int64, overwrite bool) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) != size {
+		return fmt.Errorf("size mismatch, expected %d but %d", size, len(body))
+	}
+	return s.Upload(filename, hash, body, overwrite)
+}
+
+func (s *DummyStorage) UploadTag(filename string, body []byte, expected string) error {
+	err := checkExpectedTag(filename, s.tags[filename], body, expected)
+	if err != nil {
+		return err
+	}
+
 	s.tags[filename] = body
+	s.modTimes["tag/"+filename] = time.Now()
 
 	if Verbose {
 		fmt.Printf("uploading tag '%s'\n", filename)
@@ -58,3 +87,114 @@ func (s *DummyStorage) UploadTag(filename string, body []byte) error {
 
 	return nil
 }
+
+func (s *DummyStorage) List(prefix string) ([]ObjectInfo, error) {
+	result := []ObjectInfo{}
+	for hash, body := range s.contents {
+		path := "data/" + hashPath(hash)
+		if strings.HasPrefix(path, prefix) {
+			result = append(result, ObjectInfo{Path: path, Size: int64(len(body)), ModTime: s.modTimes[path]})
+		}
+	}
+	for tag, body := range s.tags {
+		path := "tag/" + tag
+		if strings.HasPrefix(path, prefix) {
+			result = append(result, ObjectInfo{Path: path, Size: int64(len(body)), ModTime: s.modTimes[path]})
+		}
+	}
+	for tag, body := range s.histories {
+		path := "history/" + tag
+		if strings.HasPrefix(path, prefix) {
+			result = append(result, ObjectInfo{Path: path, Size: int64(len(body)), ModTime: s.modTimes[path]})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+func (s *DummyStorage) Delete(path string) error {
+	switch {
+	case strings.HasPrefix(path, "data/"):
+		hash := strings.Replace(strings.TrimPrefix(path, "data/"), "/", "", 1)
+		if _, ok := s.contents[hash]; !ok {
+			return errors.Wrap(ErrNotFound, path)
+		}
+		delete(s.contents, hash)
+	case strings.HasPrefix(path, "tag/"):
+		tag := strings.TrimPrefix(path, "tag/")
+		if _, ok := s.tags[tag]; !ok {
+			return errors.Wrap(ErrNotFound, path)
+		}
+		delete(s.tags, tag)
+	case strings.HasPrefix(path, "history/"):
+		tag := strings.TrimPrefix(path, "history/")
+		if _, ok := s.histories[tag]; !ok {
+			return errors.Wrap(ErrNotFound, path)
+		}
+		delete(s.histories, tag)
+	default:
+		return errors.Wrap(ErrNotFound, path)
+	}
+	delete(s.modTimes, path)
+
+	if Verbose {
+		fmt.Printf("deleting '%s'\n", path)
+	}
+
+	return nil
+}
+
+func (s *DummyStorage) Get(path string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(path, "data/"):
+		body, ok := s.contents[strings.Replace(strings.TrimPrefix(path, "data/"), "/", "", 1)]
+		if ok {
+			return body, nil
+		}
+	case strings.HasPrefix(path, "tag/"):
+		body, ok := s.tags[strings.TrimPrefix(path, "tag/")]
+		if ok {
+			return body, nil
+		}
+	case strings.HasPrefix(path, "history/"):
+		body, ok := s.histories[strings.TrimPrefix(path, "history/")]
+		if ok {
+			return body, nil
+		}
+	}
+	return nil, errors.Wrap(ErrNotFound, path)
+}
+
+func (s *DummyStorage) Exists(path string) (bool, error) {
+	_, err := s.Get(path)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DummyStorage) GetTag(filename string) ([]byte, error) {
+	return s.Get("tag/" + filename)
+}
+
+func (s *DummyStorage) ListTags() ([]string, error) {
+	objects, err := s.List("tag/")
+	if err != nil {
+		return nil, err
+	}
+	return tagNamesFromObjects(objects), nil
+}
+
+func (s *DummyStorage) DeleteTag(filename string) error {
+	return s.Delete("tag/" + filename)
+}
+
+func (s *DummyStorage) AppendTagHistory(filename string, line []byte) error {
+	s.histories[filename] = append(s.histories[filename], line...)
+	s.modTimes["history/"+filename] = time.Now()
+	return nil
+}
+
+func (s *DummyStorage) IsRetryable(err error) bool {
+	return isTemporaryError(errors.Cause(err))
+}
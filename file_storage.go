@@ -2,11 +2,16 @@ package cfs
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/natefinch/atomic"
+	"github.com/pkg/errors"
 )
 
 type FileStorage struct {
@@ -35,11 +40,8 @@ func (s *FileStorage) DownloaderUrl() *url.URL {
 	return s.rootUrl
 }
 
-func (s *FileStorage) Upload(filename string, hash string, body []byte, overwrite bool) error {
-	if !isHash(hash) {
-		return fmt.Errorf("%v is not hash", hash)
-	}
-
+// cabinetFilepath は、キャビネットのローカルのパスを返す
+func (s *FileStorage) cabinetFilepath() string {
 	cabinetPath := s.CabinetPath
 	if isWindows() {
 		if cabinetPath[0] == '/' {
@@ -48,8 +50,15 @@ func (s *FileStorage) Upload(filename string, hash string, body []byte, overwrit
 			cabinetPath = cabinetPath[1:]
 		}
 	}
+	return cabinetPath
+}
+
+func (s *FileStorage) Upload(filename string, hash string, body []byte, overwrite bool) error {
+	if !isHash(hash) {
+		return fmt.Errorf("%v is not hash", hash)
+	}
 
-	dataDir := filepath.Join(cabinetPath, "data")
+	dataDir := filepath.Join(s.cabinetFilepath(), "data")
 	dir := filepath.Join(dataDir, hash[0:2])
 	file := filepath.Join(dir, hash[2:])
 
@@ -75,30 +84,309 @@ func (s *FileStorage) Upload(filename string, hash string, body []byte, overwrit
 	return nil
 }
 
-func (s *FileStorage) UploadTag(filename string, body []byte) error {
-	cabinetFilepath := s.CabinetPath
-	if isWindows() {
-		if cabinetFilepath[0] == '/' {
-			cabinetFilepath = cabinetFilepath[1:]
+func (s *FileStorage) UploadReader(filename string, hash string, r io.Reader, size int64, overwrite bool) error {
+	if !isHash(hash) {
+		return fmt.Errorf("%v is not hash", hash)
+	}
+
+	dir := filepath.Join(s.cabinetFilepath(), "data", hash[0:2])
+	file := filepath.Join(dir, hash[2:])
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+
+	if !overwrite {
+		if _, err := os.Stat(file); err == nil {
+			return nil
 		}
 	}
 
-	dataDir := filepath.Join(cabinetFilepath, "tag")
+	// 途中で失敗しても中途半端なファイルが残らないように、一時ファイルに書いてから移動する
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0777)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if Verbose {
+		fmt.Printf("uploading '%s' as '%s'\n", filename, hash)
+	}
+
+	return nil
+}
+
+// UploadTag は、ロックファイルで他のプロセスからの更新を待ってから、タグを書き換える
+// 一時ファイルと、ロックファイルは "tmp/" に作成し、書き込んだ一時ファイルをタグにリネームする
+func (s *FileStorage) UploadTag(filename string, body []byte, expected string) error {
+	dataDir := filepath.Join(s.cabinetFilepath(), "tag")
+	tmpDir := filepath.Join(s.cabinetFilepath(), "tmp")
 	file := filepath.Join(dataDir, filename)
 
-	err := os.MkdirAll(dataDir, 0777)
+	for _, dir := range []string{dataDir, tmpDir} {
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	unlock, err := lockFile(filepath.Join(tmpDir, "tag-"+filename+".lock"))
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	err = ioutil.WriteFile(file, body, 0777)
+	current, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		current = nil
+	} else if err != nil {
+		return err
+	}
+	err = checkExpectedTag(filename, current, body, expected)
 	if err != nil {
 		return err
 	}
 
+	tmp, err := ioutil.TempFile(tmpDir, "tag-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(body)
+	if err == nil {
+		err = tmp.Chmod(0777)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = atomic.ReplaceFile(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
 	if Verbose {
 		fmt.Printf("uploading tag '%s'\n", filename)
 	}
 
 	return nil
 }
+
+// AppendTagHistory は、ロックファイルで他のプロセスからの追記を待ってから、タグの履歴に追記する
+func (s *FileStorage) AppendTagHistory(filename string, line []byte) error {
+	dataDir := filepath.Join(s.cabinetFilepath(), "history")
+	tmpDir := filepath.Join(s.cabinetFilepath(), "tmp")
+
+	for _, dir := range []string{dataDir, tmpDir} {
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	unlock, err := lockFile(filepath.Join(tmpDir, "history-"+filename+".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(filepath.Join(dataDir, filename), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0777)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ロックファイルの設定
+// ロックを持っている間は更新時刻を更新し続けるので、ロックを待つ時間より短い時間で、異常終了したプロセスのロックを取り除ける
+var (
+	lockTimeout  = 30 * time.Second      // ロックを取得できるまで待つ時間
+	lockStaleAge = 10 * time.Second      // 更新時刻がこれより古いロックファイルは、異常終了したプロセスのものとして取り除く
+	lockRefresh  = 2 * time.Second       // ロックを持っている間、ロックファイルの更新時刻を更新する間隔
+	lockInterval = 50 * time.Millisecond // ロックを取得し直す間隔
+)
+
+// lockFile は、pathにロックファイルを作成して、ロックを解放する関数を返す
+// すでにロックファイルがある場合は、削除されるまで待つ
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			f.Close()
+			return keepLock(path), nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if removeStaleLock(path) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("cannot lock '%s', timeout", path)
+		}
+		time.Sleep(lockInterval)
+	}
+}
+
+// keepLock は、ロックを解放するまでロックファイルの更新時刻を更新し続けて、ロックを解放する関数を返す
+func keepLock(path string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		os.Remove(path)
+	}
+}
+
+// removeStaleLock は、pathのロックファイルが古ければ取り除いて、取り除いたかどうかを返す
+// 複数のプロセスが同時に取り除かないように、一意な名前にリネームしてから、もう一度古いかどうかを確認する
+func removeStaleLock(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) <= lockStaleAge {
+		return false
+	}
+
+	// リネームできるのは一つのプロセスだけなので、他のプロセスが先に取り除いていたら失敗する
+	stale := fmt.Sprintf("%s.stale-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, stale); err != nil {
+		return false
+	}
+	defer os.Remove(stale)
+
+	// 確認してからリネームするまでに、他のプロセスが取り除いて新しくロックしていたら、元に戻す
+	info, err = os.Stat(stale)
+	if err == nil && time.Since(info.ModTime()) <= lockStaleAge {
+		os.Link(stale, path)
+		return false
+	}
+
+	if Verbose {
+		fmt.Printf("removed stale lock '%s'\n", path)
+	}
+	return true
+}
+
+func (s *FileStorage) List(prefix string) ([]ObjectInfo, error) {
+	root := s.cabinetFilepath()
+
+	// prefixのディレクトリ部分から探索する
+	dir := root
+	if pos := strings.LastIndex(prefix, "/"); pos >= 0 {
+		dir = filepath.Join(root, filepath.FromSlash(prefix[:pos]))
+	}
+
+	result := []ObjectInfo{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, prefix) {
+			result = append(result, ObjectInfo{Path: rel, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *FileStorage) Delete(path string) error {
+	err := os.Remove(filepath.Join(s.cabinetFilepath(), filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return errors.Wrap(ErrNotFound, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if Verbose {
+		fmt.Printf("deleting '%s'\n", path)
+	}
+
+	return nil
+}
+
+func (s *FileStorage) Get(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.cabinetFilepath(), filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(ErrNotFound, path)
+	}
+	return data, err
+}
+
+func (s *FileStorage) Exists(path string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.cabinetFilepath(), filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *FileStorage) GetTag(filename string) ([]byte, error) {
+	return s.Get("tag/" + filename)
+}
+
+func (s *FileStorage) ListTags() ([]string, error) {
+	objects, err := s.List("tag/")
+	if err != nil {
+		return nil, err
+	}
+	return tagNamesFromObjects(objects), nil
+}
+
+func (s *FileStorage) DeleteTag(filename string) error {
+	return s.Delete("tag/" + filename)
+}
+
+func (s *FileStorage) IsRetryable(err error) bool {
+	return false
+}
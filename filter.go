@@ -0,0 +1,258 @@
+package cfs
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter は、バケットやパックファイルの中から対象のファイルを選び、パスを書き換えるフィルタ
+//
+// ParseFilter で、以下の式から作成する(";"で区切って複数の式を並べられる)
+//
+//	include=GLOB   GLOBにマッチするファイルだけを対象にする(複数指定した場合はいずれかにマッチすればよい)
+//	exclude=GLOB   GLOBにマッチするファイルを除外する
+//	size<N, size<=N, size>N, size>=N
+//	               ファイルのサイズ(元のサイズ)で選ぶ、Nには K,M,G の単位をつけられる
+//	attr=NAME, attr!=NAME
+//	               属性で選ぶ、NAMEは compressed, crypted, zlib, zstd, lz4, cfb, gcm, keyid, chunked のいずれか
+//	strip=DIR      パスの先頭のディレクトリDIRを取り除く(DIRの下にないパスはそのまま)
+//	prefix=PREFIX  パスの先頭にPREFIXをつける(stripの後に適用される)
+//
+// GLOBは AttributeRule.Pattern と同じで、"/"を含まない場合はファイル名に、含む場合はパス全体にマッチする
+type Filter struct {
+	Includes    []PathPattern
+	Excludes    []PathPattern
+	Sizes       []SizePredicate
+	Attrs       []AttributePredicate
+	StripPrefix string
+	AddPrefix   string
+}
+
+// PathPattern は、パスにマッチするGLOBのパターンを表す
+type PathPattern struct {
+	Pattern string
+	re      *regexp.Regexp
+}
+
+// NewPathPattern は、GLOBのパターンを解析してPathPatternを作成する
+func NewPathPattern(pattern string) (PathPattern, error) {
+	re, err := regexp.Compile(globToRegexp(pattern))
+	if err != nil {
+		return PathPattern{}, err
+	}
+	return PathPattern{Pattern: pattern, re: re}, nil
+}
+
+// Match は、パターンがpathにマッチするかどうかを返す
+// パターンが"/"を含まない場合はファイル名に、含む場合はパス全体にマッチする
+func (p PathPattern) Match(filePath string) bool {
+	if !strings.Contains(p.Pattern, "/") {
+		return p.re.MatchString(path.Base(filePath))
+	}
+	return p.re.MatchString(filePath)
+}
+
+// SizePredicate は、ファイルのサイズの条件を表す
+type SizePredicate struct {
+	Op   string // "<", "<=", ">", ">="
+	Size int64
+}
+
+// AttributePredicate は、ファイルの属性の条件を表す
+type AttributePredicate struct {
+	Name   string
+	Negate bool
+}
+
+// ParseFilter は、フィルタの式を解析してFilterを作成する
+// 式がない場合は、すべてのファイルを対象にするFilterを返す
+func ParseFilter(exprs []string) (*Filter, error) {
+	f := &Filter{}
+	for _, expr := range exprs {
+		for _, term := range strings.Split(expr, ";") {
+			term = strings.TrimSpace(term)
+			if term == "" {
+				continue
+			}
+			if err := f.parseTerm(term); err != nil {
+				return nil, fmt.Errorf("invalid filter '%s': %v", term, err)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *Filter) parseTerm(term string) error {
+	switch {
+	case strings.HasPrefix(term, "size"):
+		rest := term[len("size"):]
+		for _, op := range []string{"<=", ">=", "<", ">"} {
+			if strings.HasPrefix(rest, op) {
+				size, err := parseSize(rest[len(op):])
+				if err != nil {
+					return err
+				}
+				f.Sizes = append(f.Sizes, SizePredicate{Op: op, Size: size})
+				return nil
+			}
+		}
+		return fmt.Errorf("size needs one of <, <=, >, >=")
+
+	case strings.HasPrefix(term, "attr!="), strings.HasPrefix(term, "attr="):
+		p := AttributePredicate{Negate: strings.HasPrefix(term, "attr!=")}
+		p.Name = term[strings.Index(term, "=")+1:]
+		if _, ok := attributeMatchers[p.Name]; !ok {
+			return fmt.Errorf("unknown attribute '%s'", p.Name)
+		}
+		f.Attrs = append(f.Attrs, p)
+		return nil
+	}
+
+	i := strings.Index(term, "=")
+	if i < 0 {
+		return fmt.Errorf("unknown expression")
+	}
+	key, value := term[:i], term[i+1:]
+	switch key {
+	case "include", "exclude":
+		pattern, err := NewPathPattern(value)
+		if err != nil {
+			return err
+		}
+		if key == "include" {
+			f.Includes = append(f.Includes, pattern)
+		} else {
+			f.Excludes = append(f.Excludes, pattern)
+		}
+	case "strip":
+		f.StripPrefix = value
+	case "prefix":
+		f.AddPrefix = value
+	default:
+		return fmt.Errorf("unknown key '%s'", key)
+	}
+	return nil
+}
+
+// parseSize は、"100", "10K", "1.5M" のようなサイズを解析する
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	unit := float64(1)
+	if len(s) > 0 {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			unit = 1 << 10
+		case "M":
+			unit = 1 << 20
+		case "G":
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(n * unit), nil
+}
+
+var attributeMatchers = map[string]func(ContentAttribute) bool{
+	"compressed": ContentAttribute.Compressed,
+	"crypted":    func(a ContentAttribute) bool { return a.Crypted() || a.AuthCrypted() },
+	"zlib":       func(a ContentAttribute) bool { return a.Compressed() && a.Codec() == CodecZlib },
+	"zstd":       func(a ContentAttribute) bool { return a.Compressed() && a.Codec() == CodecZstd },
+	"lz4":        func(a ContentAttribute) bool { return a.Compressed() && a.Codec() == CodecLz4 },
+	"cfb":        func(a ContentAttribute) bool { return a.Crypted() && !a.AuthCrypted() },
+	"gcm":        ContentAttribute.AuthCrypted,
+	"keyid":      ContentAttribute.KeyTagged,
+	"chunked":    ContentAttribute.Chunked,
+}
+
+// IsEmpty は、フィルタが何もしないかどうかを返す
+func (f *Filter) IsEmpty() bool {
+	return len(f.Includes) == 0 && len(f.Excludes) == 0 && len(f.Sizes) == 0 && len(f.Attrs) == 0 &&
+		f.StripPrefix == "" && f.AddPrefix == ""
+}
+
+// Match は、ファイルがフィルタの対象になるかどうかを返す
+func (f *Filter) Match(path string, size int64, attr ContentAttribute) bool {
+	if len(f.Includes) > 0 {
+		included := false
+		for _, p := range f.Includes {
+			if p.Match(path) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, p := range f.Excludes {
+		if p.Match(path) {
+			return false
+		}
+	}
+
+	for _, p := range f.Sizes {
+		var ok bool
+		switch p.Op {
+		case "<":
+			ok = size < p.Size
+		case "<=":
+			ok = size <= p.Size
+		case ">":
+			ok = size > p.Size
+		case ">=":
+			ok = size >= p.Size
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	for _, p := range f.Attrs {
+		if attributeMatchers[p.Name](attr) == p.Negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Rewrite は、フィルタのプレフィックスの設定に従ってパスを書き換える
+func (f *Filter) Rewrite(path string) string {
+	if f.StripPrefix != "" {
+		strip := strings.TrimSuffix(f.StripPrefix, "/") + "/"
+		path = strings.TrimPrefix(path, strip)
+	}
+	return f.AddPrefix + path
+}
+
+// FilterBucket は、フィルタの対象になるファイルだけを含むバケットを作成する
+// パスの書き換えで同じパスになるファイルがある場合は、エラーを返す
+func (f *Filter) FilterBucket(b *Bucket) (*Bucket, error) {
+	contents := make(map[string]Content, len(b.Contents))
+	for _, c := range b.Contents {
+		if !f.Match(c.Path, int64(c.OrigSize), c.Attr) {
+			continue
+		}
+		c.Path = f.Rewrite(c.Path)
+		if _, exists := contents[c.Path]; exists {
+			return nil, fmt.Errorf("filter rewrites multiple files to '%s'", c.Path)
+		}
+		contents[c.Path] = c
+	}
+
+	return &Bucket{
+		Tag:      b.Tag,
+		HashType: b.HashType,
+		Contents: contents,
+	}, nil
+}
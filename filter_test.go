@@ -0,0 +1,98 @@
+package cfs
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter([]string{"include=*.png; exclude=tmp/**", "size>=1K;size<1.5M", "attr!=crypted", "strip=assets/;prefix=res/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Includes) != 1 || len(f.Excludes) != 1 || len(f.Attrs) != 1 {
+		t.Errorf("invalid filter %#v", f)
+	}
+	expectedSizes := []SizePredicate{{">=", 1024}, {"<", 1536 * 1024}}
+	if !reflect.DeepEqual(f.Sizes, expectedSizes) {
+		t.Errorf("expect %v but %v", expectedSizes, f.Sizes)
+	}
+	if f.StripPrefix != "assets/" || f.AddPrefix != "res/" {
+		t.Errorf("invalid prefix %#v", f)
+	}
+
+	for _, expr := range []string{"hoge", "size=10", "size<abc", "attr=unknown", "unknown=1"} {
+		if _, err := ParseFilter([]string{expr}); err == nil {
+			t.Errorf("'%s' must be error", expr)
+		}
+	}
+
+	f, err = ParseFilter(nil)
+	if err != nil || !f.IsEmpty() {
+		t.Errorf("empty filter must be empty")
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	f, err := ParseFilter([]string{"include=*.png;include=sound/**;exclude=tmp/**;size<100;attr=compressed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path  string
+		size  int64
+		attr  ContentAttribute
+		match bool
+	}{
+		{"a.png", 10, Compressed, true},
+		{"dir/a.png", 10, Compressed, true},
+		{"sound/bgm.ogg", 10, Compressed, true},
+		{"a.txt", 10, Compressed, false},
+		{"tmp/a.png", 10, Compressed, false},
+		{"a.png", 100, Compressed, false},
+		{"a.png", 10, Crypted, false},
+	}
+	for _, c := range cases {
+		if f.Match(c.path, c.size, c.attr) != c.match {
+			t.Errorf("%s(%d, %v) must be %v", c.path, c.size, c.attr, c.match)
+		}
+	}
+}
+
+func TestFilterBucket(t *testing.T) {
+	b := NewBucket()
+	for _, path := range []string{"assets/a.png", "assets/b.txt", "assetsx/c.png", "d.png"} {
+		b.Contents[path] = Content{Path: path, OrigSize: 10}
+	}
+
+	f, err := ParseFilter([]string{"include=*.png;strip=assets;prefix=res/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered, err := f.FilterBucket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for path, c := range filtered.Contents {
+		if path != c.Path {
+			t.Errorf("invalid content path %s", c.Path)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	expected := []string{"res/a.png", "res/assetsx/c.png", "res/d.png"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expect %v but %v", expected, paths)
+	}
+
+	// 同じパスになる場合はエラー
+	b.Contents["a.png"] = Content{Path: "a.png"}
+	f, _ = ParseFilter([]string{"strip=assets"})
+	if _, err := f.FilterBucket(b); err == nil {
+		t.Errorf("duplicated path must be error")
+	}
+}
@@ -0,0 +1,181 @@
+package cfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GcOption はガーベージコレクトの設定を表す
+type GcOption struct {
+	PinnedBuckets []string      // タグから参照されていなくても残すバケットのハッシュ
+	GracePeriod   time.Duration // 更新からこの期間が経っていないオブジェクトは削除しない
+	DryRun        bool          // trueなら削除対象を調べるだけで、実際には削除しない
+	KeepHistory   int           // タグの過去のバケットをいくつ前まで残すか(0なら現在のバケットだけ、負なら全て)
+}
+
+// GcResult はガーベージコレクトの結果を表す
+type GcResult struct {
+	Referenced int          // 参照されているハッシュの数
+	Garbage    []ObjectInfo // 削除した(DryRunなら削除する)オブジェクト
+	Young      int          // 参照されていないが、猶予期間内のため残したオブジェクトの数
+}
+
+// CollectGarbage は、どのタグ/ピン留めされたバケットからも参照されていない
+// "data/" 以下のオブジェクトを削除する
+func CollectGarbage(s Storage, opt GcOption) (*GcResult, error) {
+	referenced, err := markReferenced(s, opt.PinnedBuckets, opt.KeepHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := s.List("data/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GcResult{Referenced: len(referenced), Garbage: []ObjectInfo{}}
+	deadline := time.Now().Add(-opt.GracePeriod)
+	for _, obj := range objects {
+		hash := strings.Replace(strings.TrimPrefix(obj.Path, "data/"), "/", "", 1)
+		if !isHash(hash) || referenced[hash] {
+			continue
+		}
+
+		if obj.ModTime.After(deadline) {
+			result.Young++
+			continue
+		}
+
+		if !opt.DryRun {
+			err = s.Delete(obj.Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result.Garbage = append(result.Garbage, obj)
+	}
+
+	return result, nil
+}
+
+// markReferenced は、全てのタグとピン留めされたバケットと、それらのkeepHistory個前までの過去のバケットから
+// 参照されているハッシュを返す(keepHistoryが負なら、過去のバケットを全て残す)
+// タグの過去のバケットはタグの履歴から、履歴のないタグとピン留めされたバケットは Parent をたどって探す
+// バケットが一つでも読み込めない場合は、誤って削除しないようにエラーを返す
+// ただし、過去のバケットがすでに削除されている場合は、それを無視する
+func markReferenced(s Storage, pinned []string, keepHistory int) (map[string]bool, error) {
+	tags, err := s.ListTags()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]bool{}
+	for _, tag := range tags {
+		history, err := LoadTagHistory(s, tag)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load history of %s, %v", tag, err)
+		}
+		if len(history) == 0 {
+			err = markParents(s, tag, keepHistory, referenced)
+		} else {
+			err = markTagHistory(s, tag, history, keepHistory, referenced)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hash := range pinned {
+		err = markParents(s, hash, keepHistory, referenced)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return referenced, nil
+}
+
+// markTagHistory は、タグが指しているバケットと、タグの履歴に記録されているkeepHistory個前までのバケットを残す
+func markTagHistory(s Storage, tag string, history []TagHistoryEntry, keepHistory int, referenced map[string]bool) error {
+	b, err := LoadBucketFromStorage(s, tag)
+	if err != nil {
+		return fmt.Errorf("cannot load bucket %s, %v", tag, err)
+	}
+	err = markBucket(s, b, tag, referenced)
+	if err != nil {
+		return err
+	}
+
+	kept := map[string]bool{b.Hash: true}
+	for i := len(history) - 1; i >= 0; i-- {
+		for _, hash := range []string{history[i].Hash, history[i].Previous} {
+			if hash == "" || kept[hash] {
+				continue
+			}
+			if keepHistory >= 0 && len(kept) > keepHistory {
+				return nil
+			}
+			kept[hash] = true
+
+			past, err := LoadBucketFromStorage(s, hash)
+			if IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("cannot load history of %s, %v", tag, err)
+			}
+			err = markBucket(s, past, tag, referenced)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markParents は、locationのバケットと、 Parent をたどったkeepHistory個前までのバケットを残す
+func markParents(s Storage, location string, keepHistory int, referenced map[string]bool) error {
+	b, err := LoadBucketFromStorage(s, location)
+	if err != nil {
+		return fmt.Errorf("cannot load bucket %s, %v", location, err)
+	}
+
+	for i := 0; ; i++ {
+		err = markBucket(s, b, location, referenced)
+		if err != nil {
+			return err
+		}
+		if (keepHistory >= 0 && i >= keepHistory) || b.Parent == "" {
+			return nil
+		}
+		b, err = LoadBucketFromStorage(s, b.Parent)
+		if IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot load history of %s, %v", location, err)
+		}
+	}
+}
+
+// markBucket は、バケットとバケットから参照されているハッシュをreferencedに追加する
+func markBucket(s Storage, b *Bucket, location string, referenced map[string]bool) error {
+	if Verbose {
+		fmt.Printf("marking %d files from %s (%s)\n", len(b.Contents), location, b.Hash)
+	}
+
+	referenced[b.Hash] = true
+	for _, c := range b.Contents {
+		// 分割されたファイルは、チャンクリストから参照されているチャンクも残す
+		if c.Attr.Chunked() && !referenced[c.Hash] {
+			chunks, err := loadChunkList(s, c.Hash, c.Attr)
+			if err != nil {
+				return fmt.Errorf("cannot load chunk list of %s in %s, %v", c.Path, location, err)
+			}
+			for _, chunk := range chunks {
+				referenced[chunk.Hash] = true
+			}
+		}
+		referenced[c.Hash] = true
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package cfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	c, b, dir := setupBucket()
+	b.Tag = "gc-test"
+
+	addFile(dir, "hoge", "hoge")
+	c.AddFiles(dir)
+
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := b.Sum([]byte("orphan"))
+	err = c.Storage.Upload("orphan", orphan, []byte("orphan"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 猶予期間内なので削除されない
+	result, err := CollectGarbage(c.Storage, GcOption{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Garbage) != 0 || result.Young != 1 {
+		t.Errorf("orphan must be kept in grace period, garbage %v, young %d", result.Garbage, result.Young)
+	}
+
+	result, err = CollectGarbage(c.Storage, GcOption{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Garbage) != 1 || result.Garbage[0].Path != "data/"+hashPath(orphan) {
+		t.Errorf("orphan must be garbage, but %v", result.Garbage)
+	}
+
+	result, err = CollectGarbage(c.Storage, GcOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Garbage) != 1 {
+		t.Errorf("orphan must be deleted, but %v", result.Garbage)
+	}
+
+	objects, err := c.Storage.List("data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Errorf("bucket and hoge must be remained, but %v", objects)
+	}
+}
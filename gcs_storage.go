@@ -3,7 +3,11 @@ package cfs
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -48,6 +52,10 @@ func (s *GcsStorage) DownloaderUrl() *url.URL {
 }
 
 func (s *GcsStorage) Upload(filename string, hash string, body []byte, overwrite bool) error {
+	return s.UploadReader(filename, hash, bytes.NewReader(body), int64(len(body)), overwrite)
+}
+
+func (s *GcsStorage) UploadReader(filename string, hash string, r io.Reader, size int64, overwrite bool) error {
 	path := "data/" + hashPath(hash)
 	object := &storage.Object{Name: path}
 
@@ -59,9 +67,12 @@ func (s *GcsStorage) Upload(filename string, hash string, body []byte, overwrite
 
 	// no file! lets make a file
 
-	_, err = s.service.Objects.Insert(s.BucketName, object).IfGenerationMatch(0).Media(bytes.NewBuffer(body)).Do()
-	if err != nil && googleapi.IsNotModified(err) {
-		fmt.Println(err)
+	_, err = s.service.Objects.Insert(s.BucketName, object).IfGenerationMatch(0).Media(r).Do()
+	if isGcsPreconditionFailed(err) {
+		// 確認してからアップロードするまでに、他からアップロードされた
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 	if Verbose {
@@ -70,17 +81,191 @@ func (s *GcsStorage) Upload(filename string, hash string, body []byte, overwrite
 	return nil
 }
 
-func (s *GcsStorage) UploadTag(filename string, body []byte) error {
+// UploadTag は、expectedが指定された場合は、内容を確認したときの世代(generation)を条件にしてタグを書き換える
+// 確認してから書き換えるまでに他から更新された場合は、GCSが書き換えを拒否する
+func (s *GcsStorage) UploadTag(filename string, body []byte, expected string) error {
 	path := "tag/" + filename
 	object := &storage.Object{Name: path}
 
-	_, err := s.service.Objects.Insert(s.BucketName, object).Media(bytes.NewBuffer(body)).Do()
+	call := s.service.Objects.Insert(s.BucketName, object).Media(bytes.NewBuffer(body))
+	if expected != "" {
+		current, generation, err := s.getWithGeneration(path)
+		if err != nil {
+			return err
+		}
+		err = checkExpectedTag(filename, current, body, expected)
+		if err != nil {
+			return err
+		}
+		// 存在しない場合は、世代が0なので、作成だけが許される
+		call = call.IfGenerationMatch(generation)
+	}
+
+	_, err := call.Do()
+	if isGcsPreconditionFailed(err) {
+		return errors.Wrapf(ErrTagConflict, "tag/%s: updated while uploading", filename)
+	}
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 
-	fmt.Printf("uploading '%s'\n", filename)
+	if Verbose {
+		fmt.Printf("uploading '%s'\n", path)
+	}
 
 	return nil
 }
+
+// AppendTagHistory は、読み込んだときの世代を条件にして、タグの履歴に追記したものを書き込む
+// 他と同時に追記して衝突した場合は、読み込みからやり直す
+func (s *GcsStorage) AppendTagHistory(filename string, line []byte) error {
+	path := "history/" + filename
+
+	for i := 0; i < appendAttempts; i++ {
+		current, generation, err := s.getWithGeneration(path)
+		if IsTagConflict(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if bytes.HasSuffix(current, line) {
+			// すでに追記されている(リトライの前の書き込みが成功していた)
+			return nil
+		}
+
+		object := &storage.Object{Name: path}
+		body := append(current, line...)
+		_, err = s.service.Objects.Insert(s.BucketName, object).IfGenerationMatch(generation).Media(bytes.NewReader(body)).Do()
+		if isGcsPreconditionFailed(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if Verbose {
+			fmt.Printf("uploading '%s'\n", path)
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrTagConflict, "%s: too many concurrent updates", path)
+}
+
+// getWithGeneration は、pathのオブジェクトの内容と世代を返す
+// 存在しない場合は、nilと世代0を返す
+func (s *GcsStorage) getWithGeneration(path string) ([]byte, int64, error) {
+	obj, err := s.service.Objects.Get(s.BucketName, path).Do()
+	if isGcsNotFound(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, err := s.service.Objects.Get(s.BucketName, path).Generation(obj.Generation).Download()
+	if isGcsNotFound(err) {
+		// メタデータを取得した後に、他から更新された
+		return nil, 0, errors.Wrapf(ErrTagConflict, "%s: updated while reading", path)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, obj.Generation, nil
+}
+
+func (s *GcsStorage) List(prefix string) ([]ObjectInfo, error) {
+	result := []ObjectInfo{}
+	err := s.service.Objects.List(s.BucketName).Prefix(prefix).Pages(context.Background(), func(objects *storage.Objects) error {
+		for _, obj := range objects.Items {
+			modTime, err := time.Parse(time.RFC3339, obj.Updated)
+			if err != nil {
+				return err
+			}
+			result = append(result, ObjectInfo{Path: obj.Name, Size: int64(obj.Size), ModTime: modTime})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *GcsStorage) Delete(path string) error {
+	err := s.service.Objects.Delete(s.BucketName, path).Do()
+	if isGcsNotFound(err) {
+		return errors.Wrap(ErrNotFound, path)
+	}
+	if err != nil {
+		return err
+	}
+	if Verbose {
+		fmt.Printf("deleting '%s'\n", path)
+	}
+	return nil
+}
+
+// isGcsNotFound は、GCSのエラーがオブジェクトが存在しないことによるものかどうかを返す
+func isGcsNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// isGcsPreconditionFailed は、GCSのエラーが条件(世代)が一致しなかったことによるものかどうかを返す
+func isGcsPreconditionFailed(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && e.Code == http.StatusPreconditionFailed
+}
+
+func (s *GcsStorage) Get(path string) ([]byte, error) {
+	res, err := s.service.Objects.Get(s.BucketName, path).Download()
+	if isGcsNotFound(err) {
+		return nil, errors.Wrap(ErrNotFound, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (s *GcsStorage) Exists(path string) (bool, error) {
+	_, err := s.service.Objects.Get(s.BucketName, path).Do()
+	if isGcsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *GcsStorage) GetTag(filename string) ([]byte, error) {
+	return s.Get("tag/" + filename)
+}
+
+func (s *GcsStorage) ListTags() ([]string, error) {
+	objects, err := s.List("tag/")
+	if err != nil {
+		return nil, err
+	}
+	return tagNamesFromObjects(objects), nil
+}
+
+func (s *GcsStorage) DeleteTag(filename string) error {
+	return s.Delete("tag/" + filename)
+}
+
+func (s *GcsStorage) IsRetryable(err error) bool {
+	err = errors.Cause(err)
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+	}
+	return isTemporaryError(err)
+}
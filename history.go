@@ -0,0 +1,211 @@
+package cfs
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// バケットの履歴
+//
+// アップロードしたバケットには、そのときのタグが指していたバケットのハッシュが Parent として記録される
+// バケットは変更されないので、タグから Parent をたどると、そのタグが過去に指していたバケットを順に取得できる
+//
+// また、タグを更新するたびに、タグの履歴("history/<タグ>")に一行ずつ追記する
+// タグの履歴は追記だけされるので、 Parent をたどれない更新(タグの付け替えやロールバック)も含めて、
+// タグが過去に指していたバケットを全て取得できる
+
+// タグの履歴に記録する操作
+const (
+	TagActionUpload   = "upload"   // バケットをアップロードしてタグを更新した
+	TagActionSet      = "set"      // cfs tag set でタグを付け替えた
+	TagActionRollback = "rollback" // cfs tag rollback でタグを戻した
+	TagActionRemove   = "rm"       // cfs tag rm でタグを削除した
+)
+
+// TagHistoryEntry は、タグの履歴の一回の更新を表す
+//
+// タグの履歴の一行は、以下のタブ区切りの列でできている(空の列は"-"、ユーザーはURLエスケープする)
+//
+//	更新した時刻(RFC3339) 操作 更新後のハッシュ 更新前のハッシュ 更新したユーザー
+type TagHistoryEntry struct {
+	Time     time.Time
+	Action   string
+	Hash     string // 更新後にタグが指すバケットのハッシュ(削除した場合は空)
+	Previous string // 更新前にタグが指していたバケットのハッシュ(存在しなかった場合は空)
+	User     string
+}
+
+// newTagHistoryEntry は、現在の時刻とユーザーで、タグの履歴の一行を作成する
+func newTagHistoryEntry(action string, hash string, previous string) TagHistoryEntry {
+	return TagHistoryEntry{
+		Time:     time.Now().UTC(),
+		Action:   action,
+		Hash:     hash,
+		Previous: previous,
+		User:     Option.DefaultUploader(),
+	}
+}
+
+// Line は、タグの履歴に追記する一行(改行を含む)を返す
+func (e TagHistoryEntry) Line() string {
+	col := []string{
+		e.Time.Format(time.RFC3339Nano),
+		e.Action,
+		emptyToDash(e.Hash),
+		emptyToDash(e.Previous),
+		emptyToDash(url.QueryEscape(e.User)),
+	}
+	return strings.Join(col, "\t") + "\n"
+}
+
+func emptyToDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func dashToEmpty(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// ParseTagHistory は、タグの履歴を読み込んで、古い順に返す
+// 空行と"#"で始まる行は無視する、知らない列は無視する
+func ParseTagHistory(data []byte) ([]TagHistoryEntry, error) {
+	entries := []TagHistoryEntry{}
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := parseTagHistoryLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag history at line %d, %v", i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func parseTagHistoryLine(line string) (TagHistoryEntry, error) {
+	col := strings.Split(line, "\t")
+	if len(col) < 5 {
+		return TagHistoryEntry{}, fmt.Errorf("too few columns, expect 5 but %d", len(col))
+	}
+	t, err := time.Parse(time.RFC3339Nano, col[0])
+	if err != nil {
+		return TagHistoryEntry{}, err
+	}
+	e := TagHistoryEntry{Time: t, Action: col[1], Hash: dashToEmpty(col[2]), Previous: dashToEmpty(col[3])}
+	for _, hash := range []string{e.Hash, e.Previous} {
+		if hash != "" && !isHash(hash) {
+			return TagHistoryEntry{}, fmt.Errorf("invalid hash '%s'", hash)
+		}
+	}
+	e.User, err = url.QueryUnescape(dashToEmpty(col[4]))
+	if err != nil {
+		return TagHistoryEntry{}, err
+	}
+	return e, nil
+}
+
+// LoadTagHistory は、ストレージからタグの履歴を読み込んで、古い順に返す
+// 履歴がない(この機能より前に作られたタグの)場合は、空を返す
+func LoadTagHistory(s Storage, tag string) ([]TagHistoryEntry, error) {
+	data, err := s.Get("history/" + tag)
+	if IsNotFound(err) {
+		return []TagHistoryEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseTagHistory(data)
+}
+
+// appendTagHistory は、タグの履歴に一行追記する
+func appendTagHistory(s Storage, tag string, e TagHistoryEntry) error {
+	if Verbose {
+		fmt.Printf("append tag history '%s', %s %s\n", tag, e.Action, e.Hash)
+	}
+	return s.AppendTagHistory(tag, []byte(e.Line()))
+}
+
+// recordTagHistory は、リトライしながらタグの履歴に一行追記する
+func (c *Client) recordTagHistory(tag string, e TagHistoryEntry) error {
+	count, err := c.retryPolicy().Do(fmt.Sprintf("appending tag history '%s'", tag), c.Storage.IsRetryable, func() error {
+		return appendTagHistory(c.Storage, tag, e)
+	})
+	atomic.AddInt64(&c.RetryCount, int64(count))
+	return err
+}
+
+// TagHistory は、タグの履歴をダウンロードして、古い順に返す
+// 履歴がない(この機能より前に作られたタグの)場合は、空を返す
+func (d *Downloader) TagHistory(tag string) ([]TagHistoryEntry, error) {
+	fetchUrl, err := d.BaseUrl.Parse("history/" + tag)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fetch(fetchUrl)
+	if isNotFoundStatus(err) {
+		return []TagHistoryEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseTagHistory(data)
+}
+
+// currentTagHash は、タグが指しているバケットのハッシュを返す
+// タグが存在しない場合は、空文字列を返す
+func (c *Client) currentTagHash(tag string) (string, error) {
+	var hash string
+	count, err := c.retryPolicy().Do(fmt.Sprintf("getting tag '%s'", tag), c.Storage.IsRetryable, func() error {
+		var err error
+		hash, err = getTagHash(c.Storage, tag)
+		return err
+	})
+	atomic.AddInt64(&c.RetryCount, int64(count))
+	return hash, err
+}
+
+// History は、locationのバケットから、Parent をたどって過去のバケットを新しい順に返す
+// limitが0より大きい場合は、最大でlimit個のバケットを返す
+// 途中のバケットがガーベージコレクトなどで存在しない場合は、そこまでのバケットを返す
+func (d *Downloader) History(location string, limit int) ([]*Bucket, error) {
+	b, err := d.LoadBucket(location)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []*Bucket{b}
+	visited := map[string]bool{b.Hash: true}
+	for b.Parent != "" && (limit <= 0 || len(history) < limit) {
+		if visited[b.Parent] {
+			return nil, fmt.Errorf("bucket history has a cycle at %s", b.Parent)
+		}
+		parent, err := d.LoadBucket(b.Parent)
+		if isNotFoundStatus(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		visited[parent.Hash] = true
+		history = append(history, parent)
+		b = parent
+	}
+
+	return history, nil
+}
+
+// isNotFoundStatus は、errがダウンロードで対象が存在しなかったことによるエラーかどうかを返す
+func isNotFoundStatus(err error) bool {
+	e, ok := errors.Cause(err).(*statusError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,128 @@
+package cfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	c, b, dir := setupBucket()
+	b.Tag = "history"
+
+	hashes := []string{}
+	for i, content := range []string{"v1", "v2", "v3"} {
+		if i > 0 {
+			c = &Client{Bucket: b, Storage: c.Storage}
+			c.Init()
+		}
+		addFile(dir, "hoge", content)
+		c.AddFiles(dir)
+		err := c.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, b.Hash)
+	}
+
+	d, err := NewDownloader(c.Storage.DownloaderUrl().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := d.History("history", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("history must have 3 buckets, but %d", len(history))
+	}
+	for i, h := range history {
+		if h.Hash != hashes[len(hashes)-1-i] {
+			t.Errorf("history[%d] must be %s, but %s", i, hashes[len(hashes)-1-i], h.Hash)
+		}
+	}
+	if history[2].Parent != "" {
+		t.Errorf("first bucket must not have parent, but %s", history[2].Parent)
+	}
+
+	history, err = d.History("history", 2)
+	if err != nil || len(history) != 2 {
+		t.Errorf("history must be limited, but %d %v", len(history), err)
+	}
+
+	// タグの履歴には、全ての更新が古い順に記録される
+	entries, err := d.TagHistory("history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("tag history must have 3 entries, but %v", entries)
+	}
+	for i, e := range entries {
+		previous := ""
+		if i > 0 {
+			previous = hashes[i-1]
+		}
+		if e.Action != TagActionUpload || e.Hash != hashes[i] || e.Previous != previous || e.User == "" {
+			t.Errorf("tag history[%d] is invalid, %v", i, e)
+		}
+	}
+	stored, err := LoadTagHistory(c.Storage, "history")
+	if err != nil || len(stored) != 3 {
+		t.Errorf("cannot load tag history from storage, %v %v", stored, err)
+	}
+
+	// 全ての履歴を残すなら、何も削除されない
+	result, err := CollectGarbage(c.Storage, GcOption{KeepHistory: -1, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Garbage) != 0 {
+		t.Errorf("buckets in tag history must be kept, but %v", result.Garbage)
+	}
+
+	// 一つ前までの履歴を残してガーベージコレクトすると、それより古い履歴はたどれなくなる
+	result, err = CollectGarbage(c.Storage, GcOption{KeepHistory: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Garbage) != 2 {
+		t.Errorf("the oldest bucket and its content must be deleted, but %v", result.Garbage)
+	}
+
+	os.Remove(filepath.Join(GlobalDataCacheDir(), hashes[0]))
+	history, err = d.History("history", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[1].Parent != hashes[0] {
+		t.Errorf("history must stop at collected bucket, but %d", len(history))
+	}
+}
+
+func TestTagHistoryFormat(t *testing.T) {
+	hash := "0123456789abcdef0123456789abcdef"
+	e := TagHistoryEntry{
+		Time:     time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		Action:   TagActionSet,
+		Hash:     hash,
+		Previous: "",
+		User:     "user name@host",
+	}
+
+	entries, err := ParseTagHistory([]byte("# comment\n" + e.Line() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0] != e {
+		t.Errorf("tag history must be parsed, but %v", entries)
+	}
+
+	_, err = ParseTagHistory([]byte(e.Line() + "2024-01-02T03:04:05Z\tset\thoge\t-\t-\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("malformed line must be error with line number, but %v", err)
+	}
+}
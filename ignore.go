@@ -0,0 +1,196 @@
+package cfs
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// IgnoreFileName は、除外するファイルのパターンを書くファイルの名前
+// 書式は .gitignore と同じで、そのファイルがあるディレクトリ以下に適用される
+const IgnoreFileName = ".cfsignore"
+
+// IgnoreMatcher は、.gitignore と同じ書式のパターンで、ファイルを除外するかどうかを判定する
+type IgnoreMatcher struct {
+	rules     []ignoreRule // デフォルトのパターンと、 .cfsignore のパターン
+	overrides []ignoreRule // コマンドラインで指定されたパターン(他のパターンより優先される)
+}
+
+type ignoreRule struct {
+	base     string // パターンが書かれたディレクトリ(ルートからの相対パス、ルートなら"")
+	negate   bool   // "!"で始まるパターン(除外しない)
+	dirOnly  bool   // "/"で終わるパターン(ディレクトリだけにマッチする)
+	anchored bool   // "/"を含むパターン(baseからのパス全体にマッチする)
+	re       *regexp.Regexp
+}
+
+// NewIgnoreMatcher は、ルートディレクトリに書かれたものとしてpatternsを持つIgnoreMatcherを作成する
+func NewIgnoreMatcher(patterns []string) *IgnoreMatcher {
+	m := &IgnoreMatcher{}
+	m.rules = appendIgnoreRules(m.rules, "", patterns)
+	return m
+}
+
+// Exclude は、他のパターンより優先して除外するパターンを追加する
+func (m *IgnoreMatcher) Exclude(patterns ...string) {
+	m.overrides = appendIgnoreRules(m.overrides, "", patterns)
+}
+
+// Include は、他のパターンより優先して除外しないパターンを追加する
+func (m *IgnoreMatcher) Include(patterns ...string) {
+	negated := make([]string, 0, len(patterns))
+	for _, pat := range patterns {
+		negated = append(negated, "!"+pat)
+	}
+	m.overrides = appendIgnoreRules(m.overrides, "", negated)
+}
+
+// Match は、ルートからの相対パスrelが除外されるかどうかを返す
+// 後に書かれたパターンほど優先される
+func (m *IgnoreMatcher) Match(rel string, isDir bool) bool {
+	rel = norm.NFC.String(filepath.ToSlash(rel))
+	ignored := false
+	for _, rules := range [][]ignoreRule{m.rules, m.overrides} {
+		for _, r := range rules {
+			if r.match(rel, isDir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// Walk は、root以下のファイルを、除外されるものを除いて filepath.Walk と同様に辿る
+// 辿る途中で見つけた .cfsignore のパターンは、そのディレクトリ以下に適用する
+// 除外されたディレクトリの中は辿らない
+func (m *IgnoreMatcher) Walk(root string, fn filepath.WalkFunc) error {
+	w := &IgnoreMatcher{
+		rules:     append([]ignoreRule{}, m.rules...),
+		overrides: m.overrides,
+	}
+
+	return filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil || info == nil {
+			return fn(fullPath, info, err)
+		}
+
+		rel, err := filepath.Rel(root, fullPath)
+		if err != nil {
+			return err
+		}
+		rel = norm.NFC.String(filepath.ToSlash(rel))
+
+		if rel != "." && w.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			base := rel
+			if base == "." {
+				base = ""
+			}
+			patterns, err := readIgnoreFile(filepath.Join(fullPath, IgnoreFileName))
+			if err != nil {
+				return err
+			}
+			w.rules = appendIgnoreRules(w.rules, base, patterns)
+		}
+
+		return fn(fullPath, info, nil)
+	})
+}
+
+// readIgnoreFile は、 .cfsignore ファイルのパターンを読み込む、ファイルがなければ空を返す
+func readIgnoreFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return patterns, scanner.Err()
+}
+
+func appendIgnoreRules(rules []ignoreRule, base string, patterns []string) []ignoreRule {
+	for _, pat := range patterns {
+		r, ok := parseIgnorePattern(base, pat)
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// parseIgnorePattern は、.gitignore の書式の一行を解析する
+// 空行やコメントの場合は、falseを返す
+func parseIgnorePattern(base string, pat string) (ignoreRule, bool) {
+	r := ignoreRule{base: base}
+
+	pat = strings.TrimRight(pat, " \t\r")
+	if pat == "" || strings.HasPrefix(pat, "#") {
+		return r, false
+	}
+
+	if strings.HasPrefix(pat, "!") {
+		r.negate = true
+		pat = pat[1:]
+	} else if strings.HasPrefix(pat, `\`) {
+		// "\#", "\!" はエスケープ
+		pat = pat[1:]
+	}
+
+	if strings.HasSuffix(pat, "/") {
+		r.dirOnly = true
+		pat = strings.TrimRight(pat, "/")
+	}
+
+	if strings.Contains(pat, "/") {
+		r.anchored = true
+		pat = strings.TrimPrefix(pat, "/")
+	}
+
+	if pat == "" {
+		return r, false
+	}
+
+	re, err := regexp.Compile(globToRegexp(pat))
+	if err != nil {
+		return r, false
+	}
+	r.re = re
+	return r, true
+}
+
+func (r *ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+
+	if r.anchored {
+		return r.re.MatchString(rel)
+	}
+	return r.re.MatchString(path.Base(rel))
+}
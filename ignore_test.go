@@ -0,0 +1,110 @@
+package cfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		match    bool
+	}{
+		{[]string{"*.png"}, "hoge.png", false, true},
+		{[]string{"*.png"}, "dir/hoge.png", false, true},
+		{[]string{"*.png", "!keep.png"}, "dir/keep.png", false, false},
+		{[]string{"*.png", "!keep.png", "dir/*.png"}, "dir/keep.png", false, true},
+		{[]string{"/top.txt"}, "top.txt", false, true},
+		{[]string{"/top.txt"}, "dir/top.txt", false, false},
+		{[]string{"a/**/b.txt"}, "a/b.txt", false, true},
+		{[]string{"a/**/b.txt"}, "a/x/y/b.txt", false, true},
+		{[]string{"**/tmp"}, "x/y/tmp", true, true},
+		{[]string{"tmp/"}, "x/tmp", true, true},
+		{[]string{"tmp/"}, "x/tmp", false, false},
+		{[]string{"# comment", "", `\#*`}, "#hoge", false, true},
+		{[]string{`\!bang`}, "!bang", false, true},
+		{ExcludePatterns, ".git", true, true},
+		{ExcludePatterns, "dir/hoge~", false, true},
+		{ExcludePatterns, "dir/hoge.meta", false, true},
+		{ExcludePatterns, "dir/hoge.txt", false, false},
+	}
+	for _, c := range cases {
+		m := NewIgnoreMatcher(c.patterns)
+		if m.Match(c.path, c.isDir) != c.match {
+			t.Errorf("patterns %v with %s must be %v", c.patterns, c.path, c.match)
+		}
+	}
+}
+
+func TestIgnoreOverride(t *testing.T) {
+	m := NewIgnoreMatcher([]string{"*.txt"})
+	m.Include("keep.txt")
+	m.Exclude("*.png")
+	if m.Match("keep.txt", false) || !m.Match("a.txt", false) || !m.Match("a.png", false) {
+		t.Errorf("invalid override match")
+	}
+}
+
+func TestIgnoreWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfs-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".cfsignore":         "*.log\nbuild/\n",
+		"a.txt":              "",
+		"a.log":              "",
+		"build/out.bin":      "",
+		"sub/.cfsignore":     "!important.log\n/local.txt\n",
+		"sub/important.log":  "",
+		"sub/local.txt":      "",
+		"sub/deep/local.txt": "",
+		"other/local.txt":    "",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewIgnoreMatcher(ExcludePatterns)
+	m.Exclude("other/")
+
+	found := []string{}
+	err = m.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			found = append(found, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(found)
+
+	expected := []string{"a.txt", "sub/deep/local.txt", "sub/important.log"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expect %v but %v", expected, found)
+	}
+
+	// Walkで読み込んだ .cfsignore は、元のIgnoreMatcherには影響しない
+	if m.Match("a.log", false) {
+		t.Errorf("walk must not modify the matcher")
+	}
+}
@@ -0,0 +1,192 @@
+package cfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// keyIdMagic は、鍵IDつきの暗号化データの先頭につけるマジックナンバー
+// 鍵IDつきのデータは "CFSK" + 鍵IDの長さ(1byte) + 鍵ID + 暗号化されたデータ という形式になる
+var keyIdMagic = []byte("CFSK")
+
+// maxKeyIdLength は、鍵IDの最大の長さ(byte)
+// 鍵IDの長さはヘッダに1byteで記録されるため、これより長い鍵IDは使えない
+const maxKeyIdLength = 255
+
+// validateKeyId は、鍵IDがヘッダに記録できるかどうかを確認する
+func validateKeyId(keyId string) error {
+	if len(keyId) > maxKeyIdLength {
+		return fmt.Errorf("key id '%s' is too long, must be at most %d bytes", keyId, maxKeyIdLength)
+	}
+	return nil
+}
+
+// Key は、鍵IDに対応する暗号化の鍵を返す
+// 鍵IDが空の場合は、EncryptKey を返す
+// Keyring の値は、"env:NAME" なら環境変数から、"file:PATH" ならファイルから読み込み、それ以外ならそのまま鍵として使う
+func (o *OptionInfo) Key(keyId string) (string, error) {
+	if keyId == "" {
+		return o.EncryptKey, nil
+	}
+
+	ref, ok := o.Keyring[keyId]
+	if !ok && o.KeyringFile != "" {
+		keyring, err := loadKeyringFile(o.KeyringFile)
+		if err != nil {
+			return "", err
+		}
+		ref, ok = keyring[keyId]
+	}
+	if !ok {
+		return "", fmt.Errorf("key '%s' not found in keyring", keyId)
+	}
+
+	return resolveKeyRef(keyId, ref)
+}
+
+// loadKeyringFile は、鍵IDから鍵(もしくは鍵の参照)へのJSONのmapのファイルを読み込む
+func loadKeyringFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring := map[string]string{}
+	err = json.Unmarshal(data, &keyring)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse keyring file %s, %v", path, err)
+	}
+	for keyId := range keyring {
+		if err := validateKeyId(keyId); err != nil {
+			return nil, fmt.Errorf("invalid keyring file %s, %v", path, err)
+		}
+	}
+	return keyring, nil
+}
+
+func resolveKeyRef(keyId string, ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		key := os.Getenv(ref[len("env:"):])
+		if key == "" {
+			return "", fmt.Errorf("key '%s' is not set in environment variable %s", keyId, ref[len("env:"):])
+		}
+		return key, nil
+	case strings.HasPrefix(ref, "file:"):
+		data, err := ioutil.ReadFile(ref[len("file:"):])
+		if err != nil {
+			return "", fmt.Errorf("cannot read key '%s', %v", keyId, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		return ref, nil
+	}
+}
+
+// keyIdOf は、attrの属性で暗号化するときに使う鍵IDを返す
+func keyIdOf(attr ContentAttribute) string {
+	if attr.KeyTagged() {
+		return Option.EncryptKeyId
+	}
+	return ""
+}
+
+// encodeWithKeyId は、鍵IDの鍵で圧縮/暗号化する
+// attrが鍵IDつきなら、データの先頭に鍵IDをつける
+func encodeWithKeyId(origData []byte, keyId string, attr ContentAttribute) ([]byte, bool, error) {
+	if err := validateKeyId(keyId); err != nil {
+		return nil, false, err
+	}
+
+	key := ""
+	if attr.Crypted() || attr.AuthCrypted() {
+		var err error
+		key, err = Option.Key(keyId)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	data, hashChanged, err := encode(origData, key, Option.EncryptIv, attr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if attr.KeyTagged() {
+		data = append(keyIdHeader(keyId), data...)
+	}
+
+	return data, hashChanged, nil
+}
+
+// keyIdHeader は、データの先頭につける鍵IDのヘッダを返す
+func keyIdHeader(keyId string) []byte {
+	header := append([]byte{}, keyIdMagic...)
+	header = append(header, byte(len(keyId)))
+	return append(header, keyId...)
+}
+
+// decodeWithKeyring は、データの鍵IDに対応する鍵で復号化/展開する
+func decodeWithKeyring(data []byte, attr ContentAttribute) ([]byte, error) {
+	keyId := ""
+	if attr.KeyTagged() {
+		var err error
+		keyId, data, err = splitKeyId(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key := ""
+	if attr.Crypted() || attr.AuthCrypted() {
+		var err error
+		key, err = Option.Key(keyId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return decode(data, key, Option.EncryptIv, attr)
+}
+
+// decodeBucket は、バケットのデータを復号化/展開する
+// バケットの属性はバケットの中に記録されていないため、鍵IDがついているかどうかと圧縮の方式は、データの先頭を見て判断する
+// 暗号化の方式は、改竄を検出できるGCMで復号化を試し、失敗したらCFBで復号化する
+// そのため、EncryptMode を変更しても、以前にアップロードしたバケットを読み込むことができる
+func decodeBucket(data []byte) ([]byte, error) {
+	attr := DefaultContentAttribute() &^ (Crypted | AuthCrypted | KeyTagged)
+	if bytes.HasPrefix(data, keyIdMagic) {
+		attr |= KeyTagged
+	}
+
+	var plain []byte
+	var err error
+	if encryptAttribute() == 0 {
+		plain, err = decodeWithKeyring(data, attr&^Compressed)
+	} else {
+		plain, err = decodeWithKeyring(data, (attr|AuthCrypted)&^Compressed)
+		if err != nil {
+			plain, err = decodeWithKeyring(data, (attr|Crypted)&^Compressed)
+		}
+	}
+	if err != nil || !attr.Compressed() {
+		return plain, err
+	}
+	return decompress(detectCodec(plain), plain)
+}
+
+// splitKeyId は、鍵IDつきのデータから、鍵IDと暗号化されたデータを取り出す
+func splitKeyId(data []byte) (string, []byte, error) {
+	if !bytes.HasPrefix(data, keyIdMagic) || len(data) < len(keyIdMagic)+1 {
+		return "", nil, fmt.Errorf("invalid key id header")
+	}
+	data = data[len(keyIdMagic):]
+	size := int(data[0])
+	if len(data) < 1+size {
+		return "", nil, fmt.Errorf("invalid key id header")
+	}
+	return string(data[1 : 1+size]), data[1+size:], nil
+}
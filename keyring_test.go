@@ -0,0 +1,156 @@
+package cfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupKeyring は、テスト用に鍵IDを設定し、元に戻す関数を返す
+func setupKeyring(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cfs-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "new.key")
+	err = ioutil.WriteFile(keyFile, []byte("abcdefghijabcdefghijabcdefghij12\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CFS_TEST_OLD_KEY", "09876543210987654321098765432109")
+
+	oldOption := *Option
+	Option.Keyring = map[string]string{
+		"old": "env:CFS_TEST_OLD_KEY",
+		"new": "file:" + keyFile,
+	}
+	Option.EncryptKeyId = "old"
+
+	return func() { *Option = oldOption }
+}
+
+func TestKeyring(t *testing.T) {
+	defer setupKeyring(t)()
+
+	key, err := Option.Key("old")
+	if err != nil || key != "09876543210987654321098765432109" {
+		t.Errorf("invalid key from env, '%s' %v", key, err)
+	}
+
+	key, err = Option.Key("new")
+	if err != nil || key != "abcdefghijabcdefghijabcdefghij12" {
+		t.Errorf("invalid key from file, '%s' %v", key, err)
+	}
+
+	key, err = Option.Key("")
+	if err != nil || key != Option.EncryptKey {
+		t.Errorf("empty key id must be EncryptKey, '%s' %v", key, err)
+	}
+
+	_, err = Option.Key("unknown")
+	if err == nil {
+		t.Errorf("unknown key id must be error")
+	}
+
+	attr := DefaultContentAttribute()
+	if !attr.KeyTagged() {
+		t.Errorf("attr must be key tagged")
+	}
+	data, _, err := encodeWithKeyId([]byte("hoge"), "old", attr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeWithKeyring(data, attr)
+	if err != nil || string(decoded) != "hoge" {
+		t.Errorf("cannot decode with keyring, '%s' %v", decoded, err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	defer setupKeyring(t)()
+
+	Option.ChunkThreshold = 1024
+	Option.ChunkSize = 1024
+	large := strings.Repeat("large file to be chunked\n", 1000)
+
+	c, b, dir := setupBucket()
+	addFile(dir, "hoge", "hoge")
+	addFile(dir, "fuga.raw", "fuga")
+	addFile(dir, "large", large)
+	c.AddFiles(dir)
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Contents["hoge"].KeyId != "old" || b.Contents["fuga.raw"].KeyId != "" {
+		t.Errorf("invalid key id %v", b.Contents)
+	}
+
+	Option.EncryptKeyId = "new"
+
+	d, b2 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+	c2 := &Client{Bucket: b2, Storage: c.Storage}
+	c2.Init()
+
+	count, err := c2.Rekey(d, "old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("only 2 files must be re-encrypted, but %d", count)
+	}
+	err = c2.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 古い鍵がなくても読み込める
+	delete(Option.Keyring, "old")
+
+	_, b3 := setupBucketFromURL(c.Storage.DownloaderUrl(), b2.Hash)
+	hoge := b3.Contents["hoge"]
+	if hoge.KeyId != "new" {
+		t.Errorf("key id must be new, but %s", hoge.KeyId)
+	}
+	data, err := d.FetchContent(hoge)
+	if err != nil || string(data) != "hoge" {
+		t.Errorf("cannot fetch re-encrypted file, '%s' %v", data, err)
+	}
+	data, err = d.FetchContent(b3.Contents["large"])
+	if err != nil || string(data) != large {
+		t.Errorf("cannot fetch re-encrypted chunked file, %v", err)
+	}
+}
+
+func TestBucketEncryptModeSwitch(t *testing.T) {
+	oldMode := Option.EncryptMode
+	defer func() { Option.EncryptMode = oldMode }()
+
+	for _, modes := range [][2]string{{EncryptModeCFB, EncryptModeGCM}, {EncryptModeGCM, EncryptModeCFB}} {
+		Option.EncryptMode = modes[0]
+		c, b, dir := setupBucket()
+		addFile(dir, "hoge", "hoge")
+		c.AddFiles(dir)
+		err := c.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 方式を変更しても、以前のバケットを読み込める
+		Option.EncryptMode = modes[1]
+		b2, err := LoadBucketFromStorage(c.Storage, b.Hash)
+		if err != nil {
+			t.Fatalf("cannot load %s bucket with %s, %v", modes[0], modes[1], err)
+		}
+		d, b3 := setupBucketFromURL(c.Storage.DownloaderUrl(), b.Hash)
+		if _, ok := b2.Contents["hoge"]; !ok {
+			t.Errorf("invalid bucket contents %v", b2.Contents)
+		}
+		data, err := d.FetchContent(b3.Contents["hoge"])
+		if err != nil || string(data) != "hoge" {
+			t.Errorf("cannot fetch %s file with %s, '%s' %v", modes[0], modes[1], data, err)
+		}
+	}
+}
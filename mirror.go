@@ -0,0 +1,113 @@
+package cfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// RemoveUntracked は、dirの中のバケットに含まれないファイルと、それにより空になるディレクトリを削除する
+// excludesのglobパターンにパスかファイル名がマッチするファイルやディレクトリは削除しない
+// dryRunがtrueなら、削除はせずに削除対象の一覧だけを返す
+// 返すパスはdirからの相対パスで、ディレクトリは末尾に"/"をつける
+func RemoveUntracked(b *Bucket, dir string, excludes []string, dryRun bool) ([]string, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return []string{}, nil
+	}
+
+	files := []string{}
+	dirs := []string{}
+	kept := map[string]bool{} // 削除しないファイルを含むディレクトリ
+
+	keep := func(rel string) {
+		for d := path.Dir(rel); d != "."; d = path.Dir(d) {
+			kept[d] = true
+		}
+	}
+
+	err := filepath.Walk(dir, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fullPath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		// OSXのためにUTF-8文字列を正規化する
+		rel = norm.NFC.String(filepath.ToSlash(rel))
+
+		if isExcluded(rel, excludes) {
+			keep(rel)
+			if info.IsDir() {
+				kept[rel] = true
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			dirs = append(dirs, rel)
+			return nil
+		}
+
+		if _, ok := b.Contents[rel]; ok {
+			keep(rel)
+		} else {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, 0, len(files))
+	removed = append(removed, files...)
+	for _, d := range dirs {
+		if !kept[d] {
+			removed = append(removed, d+"/")
+		}
+	}
+
+	sort.Strings(removed)
+
+	if dryRun {
+		return removed, nil
+	}
+
+	// 子供から順に削除するため、逆順に削除する
+	for i := len(removed) - 1; i >= 0; i-- {
+		rel := removed[i]
+		err := os.Remove(filepath.Join(dir, filepath.FromSlash(strings.TrimSuffix(rel, "/"))))
+		if err != nil {
+			return nil, err
+		}
+		if Verbose {
+			fmt.Printf("removed %s\n", rel)
+		}
+	}
+
+	return removed, nil
+}
+
+// isExcluded は、relかそのファイル名がpatternsのどれかにマッチするかどうかを返す
+func isExcluded(rel string, patterns []string) bool {
+	base := path.Base(rel)
+	for _, pat := range patterns {
+		if match, _ := path.Match(pat, rel); match {
+			return true
+		}
+		if match, _ := path.Match(pat, base); match {
+			return true
+		}
+	}
+	return false
+}
@@ -4,21 +4,65 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"time"
+)
+
+// EncryptMode で指定できる暗号化の方式
+const (
+	EncryptModeCFB = "cfb" // AES-CFB、全てのファイルで同じIVを使う(古い形式)
+	EncryptModeGCM = "gcm" // AES-GCM、ファイルごとにnonceを作成し、改竄を検出できる
 )
 
 type OptionInfo struct {
-	Tag        string
-	Repository string
-	Recursive  bool
-	Flatten    bool
-	Compress   bool
-	EncryptKey string
-	EncryptIv  string
-	NoCache    bool
+	Tag         string
+	Repository  string
+	Recursive   bool
+	Flatten     bool
+	Compress    bool
+	Codec       string // 圧縮の方式("zlib", "zstd", "lz4", 空なら "zlib")
+	EncryptKey  string
+	EncryptIv   string
+	EncryptMode string // 暗号化の方式("cfb" か "gcm", 空なら "cfb")
+	NoCache     bool
+	HashType    string // 新しく作るバケットのハッシュの種類("md5" か "sha256", 空なら "md5")
+
+	// keyring setting
+	EncryptKeyId string            // 暗号化に使う鍵のID(空なら EncryptKey を使い、鍵IDはつけない)
+	Keyring      map[string]string // 鍵IDから鍵への対応("env:NAME", "file:PATH" で環境変数やファイルから読み込める)
+	KeyringFile  string            // 鍵IDから鍵への対応を書いたJSONファイルのパス
+
+	// adaptive compression setting
+	AdaptiveCompress   bool    // 圧縮しても小さくならないファイルを圧縮せずに保存するかどうか
+	MinCompressRatio   float64 // 圧縮して減るサイズがこの割合より小さい場合は圧縮しない
+	CompressSampleSize int     // このサイズより大きいファイルは、先頭のこのサイズだけ圧縮して判断する(0なら全体)
+
+	// StreamThreshold より大きいファイルは、全体をメモリに読み込まずに一時ファイルを使ってアップロードする(0なら常にメモリに読み込む)
+	StreamThreshold int64
+
+	// chunking setting
+	ChunkThreshold int64 // このサイズより大きいファイルは、内容に応じて分割して保存する(0なら分割しない)
+	ChunkSize      int   // 分割するときの平均のサイズ(0なら DefaultChunkSize)
+
+	// AttributeRules は、パスごとの圧縮や暗号化の設定(最初にマッチしたものが使われる)
+	// 設定ファイルで指定した場合は、デフォルトのルールは使われない
+	AttributeRules []AttributeRule
+
+	// retry setting
+	RetryMaxAttempts int     // アップロード/ダウンロードの最大試行回数
+	RetryBaseDelay   int     // 最初のリトライまでの待ち時間(ミリ秒)
+	RetryMaxDelay    int     // リトライの待ち時間の上限(ミリ秒)
+	RetryJitter      float64 // リトライの待ち時間をランダムに増減させる割合
+
+	// ProtectedTags は、--force を指定しないと上書きできないタグの名前のパターン("release-*"など)
+	ProtectedTags []string
 
 	// common setting
-	Cabinet string // アップロード先のURL
-	Url     string // ダウンロード先のURL
+	Uploader string // タグの履歴に記録するアップロードしたユーザー(空なら "ユーザー名@ホスト名")
+	Cabinet  string // アップロード先のURL
+	Url      string // ダウンロード先のURL
 
 	// Google Cloud Storage setting
 
@@ -31,6 +75,18 @@ var Option = &OptionInfo{
 	EncryptKey: "",
 	EncryptIv:  "",
 	Cabinet:    "file:///var/cfs",
+
+	MinCompressRatio:   0.1,
+	CompressSampleSize: 64 * 1024,
+
+	StreamThreshold: 32 * 1024 * 1024,
+
+	AttributeRules: defaultAttributeRules(),
+
+	RetryMaxAttempts: 5,
+	RetryBaseDelay:   500,
+	RetryMaxDelay:    30000,
+	RetryJitter:      0.2,
 }
 
 // cfsを使うときの設定ファイルを読み込む
@@ -52,5 +108,87 @@ func LoadDefaultOptions(configFile string) {
 }
 
 func (o *OptionInfo) Parse(data []byte) error {
-	return json.Unmarshal(data, o)
+	// 既存のスライスの要素に上書きされないように、一度空にしてから読み込む
+	defaultRules := o.AttributeRules
+	o.AttributeRules = nil
+
+	err := json.Unmarshal(data, o)
+	if err != nil {
+		return err
+	}
+
+	if o.AttributeRules == nil {
+		o.AttributeRules = defaultRules
+	}
+
+	_, err = ParseCodec(o.Codec)
+	if err != nil {
+		return err
+	}
+
+	_, err = NewHash(o.DefaultHashType())
+	if err != nil {
+		return err
+	}
+
+	err = validateKeyId(o.EncryptKeyId)
+	if err != nil {
+		return fmt.Errorf("invalid EncryptKeyId, %v", err)
+	}
+	for keyId := range o.Keyring {
+		err = validateKeyId(keyId)
+		if err != nil {
+			return fmt.Errorf("invalid Keyring, %v", err)
+		}
+	}
+
+	for _, pattern := range o.ProtectedTags {
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid ProtectedTags '%s', %v", pattern, err)
+		}
+	}
+
+	for i := range o.AttributeRules {
+		err = o.AttributeRules[i].compile()
+		if err != nil {
+			return fmt.Errorf("invalid AttributeRules[%d], %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// DefaultHashType は、新しく作るバケットのハッシュの種類を返す
+func (o *OptionInfo) DefaultHashType() string {
+	if o.HashType == "" {
+		return HashTypeMD5
+	}
+	return o.HashType
+}
+
+// DefaultUploader は、タグの履歴に記録するアップロードしたユーザーを返す
+func (o *OptionInfo) DefaultUploader() string {
+	if o.Uploader != "" {
+		return o.Uploader
+	}
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// RetryPolicy は、設定からアップロード/ダウンロードのリトライの設定を作成する
+func (o *OptionInfo) RetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: o.RetryMaxAttempts,
+		BaseDelay:   time.Duration(o.RetryBaseDelay) * time.Millisecond,
+		MaxDelay:    time.Duration(o.RetryMaxDelay) * time.Millisecond,
+		Jitter:      o.RetryJitter,
+	}
 }
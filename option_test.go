@@ -1,6 +1,7 @@
 package cfs
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -11,3 +12,33 @@ func TestParse(t *testing.T) {
 		t.Errorf("cannot parse")
 	}
 }
+
+func TestParseInvalidCodec(t *testing.T) {
+	opt := &OptionInfo{}
+	err := opt.Parse([]byte(`{"Codec":"unknown"}`))
+	if err == nil {
+		t.Errorf("unknown codec must be error")
+	}
+}
+
+func TestParseTooLongKeyId(t *testing.T) {
+	longId := strings.Repeat("k", maxKeyIdLength+1)
+
+	opt := &OptionInfo{}
+	err := opt.Parse([]byte(`{"EncryptKeyId":"` + longId + `"}`))
+	if err == nil {
+		t.Errorf("too long EncryptKeyId must be error")
+	}
+
+	opt = &OptionInfo{}
+	err = opt.Parse([]byte(`{"Keyring":{"` + longId + `":"key"}}`))
+	if err == nil {
+		t.Errorf("too long key id in Keyring must be error")
+	}
+
+	opt = &OptionInfo{}
+	err = opt.Parse([]byte(`{"EncryptKeyId":"` + longId[1:] + `"}`))
+	if err != nil {
+		t.Errorf("key id of %d bytes must be valid, %v", maxKeyIdLength, err)
+	}
+}
@@ -2,7 +2,6 @@ package pack
 
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -18,8 +17,9 @@ import (
 
 // PackFile パックファイルを表す
 type PackFile struct {
-	Version int
-	Entries []Entry
+	Version  int
+	HashType string // エントリのハッシュの種類(空なら "md5")
+	Entries  []Entry
 }
 
 // Entry パックファイルの中の一つのファイルを表す
@@ -32,19 +32,29 @@ type Entry struct {
 }
 
 // PackFileVersion は現在のPackファイルのバージョン
-const PackFileVersion = 1
+// バージョン1はmd5のハッシュだけを格納でき、バージョン2はヘッダにハッシュのサイズを持つ
+// md5のパックファイルは、古いcfsでも読めるようにバージョン1で書き込む
+const PackFileVersion = 2
+
+// packFileVersionMD5 はmd5のハッシュを格納するPackファイルのバージョン
+const packFileVersionMD5 = 1
 
 // 標準的に使用するエンディアン
 var endian = binary.LittleEndian
 
 // NewPackFile PackFileを新規に作成する
+// ハッシュの種類は、エントリのハッシュから判断する
 func NewPackFile(entries []Entry) *PackFile {
-	return &PackFile{Version: PackFileVersion, Entries: entries}
+	hashType := cfs.HashTypeMD5
+	if len(entries) > 0 && cfs.HashTypeOf(entries[0].Hash) != "" {
+		hashType = cfs.HashTypeOf(entries[0].Hash)
+	}
+	return &PackFile{Version: PackFileVersion, HashType: hashType, Entries: entries}
 }
 
 // Parse PackファイルをParseする
 func Parse(r io.Reader) (*PackFile, error) {
-	err := decodeHeader(r)
+	hashType, err := decodeHeader(r)
 	if err != nil {
 		return nil, err
 	}
@@ -61,7 +71,7 @@ func Parse(r io.Reader) (*PackFile, error) {
 		return nil, err
 	}
 
-	entries, err := decodeEntryList(entryList, int(entrySize))
+	entries, err := decodeEntryList(entryList, hashSize(hashType))
 	if err != nil {
 		return nil, err
 	}
@@ -78,13 +88,18 @@ func Parse(r io.Reader) (*PackFile, error) {
 		}
 	}
 
-	return &PackFile{Version: PackFileVersion, Entries: entries}, nil
+	return &PackFile{Version: PackFileVersion, HashType: hashType, Entries: entries}, nil
 
 }
 
 // Pack PackFileをファイルに書き込む
 func Pack(w io.Writer, pack *PackFile, fn func(string) io.Reader) error {
-	_, err := w.Write(encodeHeader())
+	hashType := pack.hashType()
+	header, err := encodeHeader(hashType)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
 	if err != nil {
 		return err
 	}
@@ -93,7 +108,7 @@ func Pack(w io.Writer, pack *PackFile, fn func(string) io.Reader) error {
 	sort.Slice(pack.Entries, func(i, j int) bool { return pack.Entries[i].Path < pack.Entries[j].Path })
 
 	// EntryListのサイズを取得する
-	dummyEntry, err := encodeEntryList(pack.Entries, 0)
+	dummyEntry, err := encodeEntryList(pack.Entries, 0, hashSize(hashType))
 	if err != nil {
 		return err
 	}
@@ -103,7 +118,7 @@ func Pack(w io.Writer, pack *PackFile, fn func(string) io.Reader) error {
 		return err
 	}
 
-	entry, err := encodeEntryList(pack.Entries, 3+4+len(dummyEntry))
+	entry, err := encodeEntryList(pack.Entries, len(header)+4+len(dummyEntry), hashSize(hashType))
 	if err != nil {
 		return err
 	}
@@ -142,9 +157,19 @@ func Pack(w io.Writer, pack *PackFile, fn func(string) io.Reader) error {
 }
 
 // NewPackFileFromDir ディレクトリを指定して、パックファイルを作成する
-func NewPackFileFromDir(dir string) (*PackFile, error) {
+// ignoreと、ディレクトリ内の .cfsignore で除外されるファイルはパックに含めない
+// エントリのハッシュは cfs.Option.HashType の種類で計算する
+func NewPackFileFromDir(dir string, ignore *cfs.IgnoreMatcher) (*PackFile, error) {
+	if ignore == nil {
+		ignore = cfs.NewIgnoreMatcher(nil)
+	}
+	hashType := cfs.Option.DefaultHashType()
+
 	entries := []Entry{}
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	err := ignore.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		// OSXのためにUTF-8文字列を正規化する See: https://text.baldanders.info/golang/unicode-normalization/
 		path = norm.NFC.String(path)
 		if !info.IsDir() {
@@ -154,7 +179,12 @@ func NewPackFileFromDir(dir string) (*PackFile, error) {
 			if err != nil {
 				return err
 			}
-			hash := fmt.Sprintf("%x", md5.Sum(data))
+			h, err := cfs.NewHash(hashType)
+			if err != nil {
+				return err
+			}
+			h.Write(data)
+			hash := fmt.Sprintf("%x", h.Sum(nil))
 
 			entries = append(entries, Entry{
 				Path: entryPath,
@@ -169,11 +199,15 @@ func NewPackFileFromDir(dir string) (*PackFile, error) {
 		return nil, err
 	}
 
-	return &PackFile{Version: PackFileVersion, Entries: entries}, nil
+	return &PackFile{Version: PackFileVersion, HashType: hashType, Entries: entries}, nil
 }
 
 // Patch パッチを作成する
 func Patch(base, current *PackFile) (*PackFile, error) {
+	if base.hashType() != current.hashType() {
+		return nil, fmt.Errorf("cannot patch between different hash types, %s and %s", base.hashType(), current.hashType())
+	}
+
 	// Make base entries map by path.
 	baseEntryMap := map[string]Entry{}
 	for _, e := range base.Entries {
@@ -207,14 +241,59 @@ func Patch(base, current *PackFile) (*PackFile, error) {
 		}
 	}
 
-	return &PackFile{Version: PackFileVersion, Entries: entries}, nil
+	return &PackFile{Version: PackFileVersion, HashType: current.HashType, Entries: entries}, nil
+}
+
+// Filter フィルタの対象になるエントリだけを含むパックファイルを作成する
+// 属性の条件は、そのファイルをアップロードした場合の属性で判定する
+func Filter(pak *PackFile, f *cfs.Filter) (*PackFile, error) {
+	attrBucket := &cfs.Bucket{}
+	exists := map[string]bool{}
+	entries := make([]Entry, 0, len(pak.Entries))
+	for _, e := range pak.Entries {
+		if !f.Match(e.Path, int64(e.Size), attrBucket.GetAttribute(e.Path)) {
+			continue
+		}
+		e.Path = f.Rewrite(e.Path)
+		if exists[e.Path] {
+			return nil, fmt.Errorf("filter rewrites multiple files to '%s'", e.Path)
+		}
+		exists[e.Path] = true
+		entries = append(entries, e)
+	}
+
+	return &PackFile{Version: PackFileVersion, HashType: pak.HashType, Entries: entries}, nil
+}
+
+// hashType は、エントリのハッシュの種類を返す
+func (pak *PackFile) hashType() string {
+	if pak.HashType == "" {
+		return cfs.HashTypeMD5
+	}
+	return pak.HashType
+}
+
+// hashSize は、ハッシュの種類ごとのハッシュのバイト数を返す
+func hashSize(hashType string) int {
+	h, err := cfs.NewHash(hashType)
+	if err != nil {
+		return 0
+	}
+	return h.Size()
 }
 
-func encodeHeader() []byte {
-	return []byte{byte('T'), byte('P'), PackFileVersion}
+func encodeHeader(hashType string) ([]byte, error) {
+	size := hashSize(hashType)
+	if size == 0 {
+		return nil, fmt.Errorf("invalid hash type '%s'", hashType)
+	}
+	if hashType == cfs.HashTypeMD5 {
+		return []byte{byte('T'), byte('P'), packFileVersionMD5}, nil
+	}
+	return []byte{byte('T'), byte('P'), PackFileVersion, byte(size)}, nil
 }
 
-func encodeEntryList(entries []Entry, bodyPos int) ([]byte, error) {
+func encodeEntryList(entries []Entry, bodyPos int, hashSize int) ([]byte, error) {
 	w := bytes.NewBuffer(nil)
 	pos := bodyPos
 
@@ -234,6 +313,9 @@ func encodeEntryList(entries []Entry, bodyPos int) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+		if len(hashBytes) != hashSize {
+			return nil, fmt.Errorf("invalid hash size in %s, expect %d but %d", e.Path, hashSize, len(hashBytes))
+		}
 		w.Write(hashBytes)
 		pos += e.Size
 	}
@@ -241,23 +323,38 @@ func encodeEntryList(entries []Entry, bodyPos int) ([]byte, error) {
 	return w.Bytes(), nil
 }
 
-func decodeHeader(r io.Reader) error {
+// decodeHeader は、ヘッダを読み込んで、エントリのハッシュの種類を返す
+func decodeHeader(r io.Reader) (string, error) {
 	var header [3]byte
 	_, err := io.ReadFull(r, header[:])
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if header[0] != byte('T') || header[1] != byte('P') {
-		return fmt.Errorf("Invalid file header, magic")
+		return "", fmt.Errorf("Invalid file header, magic")
 	}
-	if header[2] != PackFileVersion {
-		return fmt.Errorf("Invalid file header, version")
+	switch header[2] {
+	case packFileVersionMD5:
+		return cfs.HashTypeMD5, nil
+	case PackFileVersion:
+		var size [1]byte
+		_, err := io.ReadFull(r, size[:])
+		if err != nil {
+			return "", err
+		}
+		for _, hashType := range []string{cfs.HashTypeMD5, cfs.HashTypeSHA256} {
+			if hashSize(hashType) == int(size[0]) {
+				return hashType, nil
+			}
+		}
+		return "", fmt.Errorf("Invalid file header, hash size %d", size[0])
+	default:
+		return "", fmt.Errorf("Invalid file header, version")
 	}
-	return nil
 }
 
-func decodeEntryList(bin []byte, entrySize int) ([]Entry, error) {
+func decodeEntryList(bin []byte, hashSize int) ([]Entry, error) {
 	r := bytes.NewBuffer(bin)
 
 	var entryCount uint32
@@ -273,7 +370,7 @@ func decodeEntryList(bin []byte, entrySize int) ([]Entry, error) {
 		var pathBytes [256]byte
 		var pos uint32
 		var size uint32
-		var hash [16]byte
+		hash := make([]byte, hashSize)
 
 		err := binary.Read(r, endian, &pathLen)
 		if err != nil {
@@ -295,14 +392,14 @@ func decodeEntryList(bin []byte, entrySize int) ([]Entry, error) {
 			return nil, err
 		}
 
-		_, err = io.ReadFull(r, hash[:])
+		_, err = io.ReadFull(r, hash)
 		if err != nil {
 			return nil, err
 		}
 
 		entries[i] = Entry{
 			Path: string(pathBytes[:pathLen]),
-			Hash: hex.EncodeToString(hash[:]),
+			Hash: hex.EncodeToString(hash),
 			Pos:  int(pos),
 			Size: int(size),
 		}
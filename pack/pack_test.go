@@ -7,34 +7,46 @@ import (
 )
 
 func TestPack(t *testing.T) {
-	hash := "0123456789abcdef0123456789abcdef"
-	entries := []Entry{
-		{Path: "hoge", Hash: hash, Size: 4},
-		{Path: "fugafuga", Hash: hash, Size: 8},
-		{Path: "piyo", Hash: hash, Size: 4},
-	}
-	w := bytes.NewBuffer(nil)
-	origPack := NewPackFile(entries)
-	err := Pack(w, origPack, func(s string) io.Reader { return bytes.NewBufferString(s) })
-	if err != nil {
-		t.Error(err)
-		return
-	}
+	for _, hash := range []string{
+		"0123456789abcdef0123456789abcdef",
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	} {
+		entries := []Entry{
+			{Path: "hoge", Hash: hash, Size: 4},
+			{Path: "fugafuga", Hash: hash, Size: 8},
+			{Path: "piyo", Hash: hash, Size: 4},
+		}
+		w := bytes.NewBuffer(nil)
+		origPack := NewPackFile(entries)
+		err := Pack(w, origPack, func(s string) io.Reader { return bytes.NewBufferString(s) })
+		if err != nil {
+			t.Error(err)
+			return
+		}
 
-	bin := w.Bytes()
+		bin := w.Bytes()
 
-	r := bytes.NewBuffer(bin)
-	pack, err := Parse(r)
-	if err != nil {
-		t.Error(err)
-		return
-	}
+		// md5のパックファイルは、古いバージョンのまま書き込む
+		if len(hash) == 32 && bin[2] != packFileVersionMD5 {
+			t.Errorf("md5 pack file must be version %d, but %d", packFileVersionMD5, bin[2])
+		}
 
-	for i, e := range pack.Entries {
-		e2 := entries[i]
-		if e.Path != e2.Path || e.Size != e2.Size || e.Hash != e2.Hash || e.Pos != e2.Pos {
-			t.Errorf("not same entry %v %v", e, e2)
+		r := bytes.NewBuffer(bin)
+		pack, err := Parse(r)
+		if err != nil {
+			t.Error(err)
 			return
 		}
+		if pack.HashType != origPack.HashType {
+			t.Errorf("hash type must be %s, but %s", origPack.HashType, pack.HashType)
+		}
+
+		for i, e := range pack.Entries {
+			e2 := entries[i]
+			if e.Path != e2.Path || e.Size != e2.Size || e.Hash != e2.Hash || e.Pos != e2.Pos {
+				t.Errorf("not same entry %v %v", e, e2)
+				return
+			}
+		}
 	}
 }
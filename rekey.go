@@ -0,0 +1,122 @@
+package cfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Rekey は、バケットの中の鍵ID fromで暗号化されたファイルを、鍵ID toで暗号化し直してアップロードする
+// 鍵IDを使っていない(EncryptKey で暗号化された)ファイルを対象にする場合は、fromに空文字列を指定する
+// 暗号化し直したファイルの数を返す。バケットの保存は Finish で行う
+func (c *Client) Rekey(d *Downloader, from string, to string) (int, error) {
+	b := c.Bucket
+
+	paths := make([]string, 0, len(b.Contents))
+	for path := range b.Contents {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	count := 0
+	for _, path := range paths {
+		content := b.Contents[path]
+		if !(content.Attr.Crypted() || content.Attr.AuthCrypted()) || content.KeyId != from {
+			continue
+		}
+
+		attr := content.Attr &^ KeyTagged
+		if to != "" {
+			attr |= KeyTagged
+		}
+
+		var hash string
+		var size int
+		var err error
+		if content.Attr.Chunked() {
+			hash, size, err = c.rekeyChunked(d, content, to, attr)
+		} else {
+			hash, size, err = c.rekeyData(d, content, to, attr)
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if Verbose {
+			fmt.Printf("rekey %s (%s -> %s)\n", path, content.Hash, hash)
+		}
+
+		content.Hash = hash
+		content.Size = size
+		content.Attr = attr
+		content.KeyId = to
+		b.Contents[path] = content
+		count++
+	}
+
+	return count, nil
+}
+
+// rekeyData は、一つのファイルを暗号化し直してアップロードのキューに追加する
+func (c *Client) rekeyData(d *Downloader, content Content, to string, attr ContentAttribute) (string, int, error) {
+	// TODO: 0 bytesのファイルはアップロードがされていないため、空ファイルとして扱う
+	var err error
+	origData := []byte{}
+	if content.Size > 0 {
+		origData, err = d.FetchContent(content)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	return c.enqueueEncoded(content.Path, origData, to, attr)
+}
+
+// rekeyChunked は、分割されたファイルの全てのチャンクとチャンクリストを暗号化し直してアップロードのキューに追加する
+func (c *Client) rekeyChunked(d *Downloader, content Content, to string, attr ContentAttribute) (string, int, error) {
+	fromAttr := content.Attr &^ Chunked
+	toAttr := attr &^ Chunked
+
+	var list bytes.Buffer
+	err := d.fetchDecoded(content.Hash, fromAttr, &list)
+	if err != nil {
+		return "", 0, err
+	}
+	chunks, err := parseChunkList(list.Bytes())
+	if err != nil {
+		return "", 0, err
+	}
+
+	for i, chunk := range chunks {
+		var data bytes.Buffer
+		err = d.fetchDecoded(chunk.Hash, fromAttr, &data)
+		if err != nil {
+			return "", 0, err
+		}
+		chunks[i].Hash, chunks[i].Size, err = c.enqueueEncoded(fmt.Sprintf("%s#%d", content.Path, i), data.Bytes(), to, toAttr)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	hash, size, err := c.enqueueEncoded(content.Path, dumpChunkList(chunks), to, toAttr)
+	if err != nil {
+		return "", 0, err
+	}
+	return hash, chunkedSize(size, chunks), nil
+}
+
+// enqueueEncoded は、鍵ID toの鍵でエンコードしてアップロードのキューに追加する
+func (c *Client) enqueueEncoded(filename string, origData []byte, to string, attr ContentAttribute) (string, int, error) {
+	data, _, err := encodeWithKeyId(origData, to, attr)
+	if err != nil {
+		return "", 0, err
+	}
+	hash := c.Bucket.Sum(data)
+
+	err = c.enqueue(uploadRequest{Filename: filename, Hash: hash, Data: data})
+	if err != nil {
+		return "", 0, err
+	}
+	return hash, len(data), nil
+}
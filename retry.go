@@ -0,0 +1,74 @@
+package cfs
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetryPolicy は、失敗した処理のリトライの設定を表す
+type RetryPolicy struct {
+	MaxAttempts int           // 最大試行回数(1以下ならリトライしない)
+	BaseDelay   time.Duration // 最初のリトライまでの待ち時間、以降リトライごとに倍になる
+	MaxDelay    time.Duration // 待ち時間の上限(0なら上限なし)
+	Jitter      float64       // 待ち時間をランダムに増減させる割合(0.0〜1.0)
+}
+
+// NoRetry はリトライしないRetryPolicy
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// Do は、fnが成功するか、retryableがfalseを返すエラーになるか、最大試行回数に達するまでfnを繰り返す
+// リトライした回数と最後のエラーを返す
+func (p RetryPolicy) Do(name string, retryable func(error) bool, fn func() error) (int, error) {
+	retryCount := 0
+	for {
+		err := fn()
+		if err == nil {
+			return retryCount, nil
+		}
+		if retryCount+1 >= p.MaxAttempts || !retryable(err) {
+			return retryCount, err
+		}
+
+		retryCount++
+		delay := p.delay(retryCount)
+		if Verbose {
+			fmt.Printf("retry %s after %v (%d/%d), %v\n", name, delay, retryCount, p.MaxAttempts-1, err)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// delay は、retryCount回目のリトライまでの待ち時間を返す
+func (p RetryPolicy) delay(retryCount int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retryCount; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + p.Jitter*(rand.Float64()*2-1)))
+	}
+	return delay
+}
+
+// isTemporaryError は、タイムアウトなどの一時的なエラーかどうかを返す
+func isTemporaryError(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	if e, ok := err.(interface{ Temporary() bool }); ok && e.Temporary() {
+		return true
+	}
+	return false
+}
@@ -1,11 +1,18 @@
 package cfs
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
+	"github.com/pkg/errors"
 )
 
 type S3Storage struct {
@@ -48,6 +55,10 @@ func (s *S3Storage) DownloaderUrl() *url.URL {
 }
 
 func (s *S3Storage) Upload(filename string, hash string, body []byte, overwrite bool) error {
+	return s.UploadReader(filename, hash, bytes.NewReader(body), int64(len(body)), overwrite)
+}
+
+func (s *S3Storage) UploadReader(filename string, hash string, r io.Reader, size int64, overwrite bool) error {
 	path := "data/" + hashPath(hash)
 
 	if !overwrite {
@@ -62,8 +73,8 @@ func (s *S3Storage) Upload(filename string, hash string, body []byte, overwrite
 	}
 
 	// TODO: sizeが0だとエラーになるため、送信しないようにしている
-	if len(body) > 0 {
-		err := s.bucket.Put(path, body, "binary/octet-stream", s3.BucketOwnerFull, s3.Options{})
+	if size > 0 {
+		err := s.bucket.PutReader(path, r, size, "binary/octet-stream", s3.BucketOwnerFull, s3.Options{})
 		if err != nil {
 			return err
 		}
@@ -75,15 +86,217 @@ func (s *S3Storage) Upload(filename string, hash string, body []byte, overwrite
 	return nil
 }
 
-func (s *S3Storage) UploadTag(filename string, body []byte) error {
+// UploadTag は、expectedが指定された場合は、条件付きの書き込みでタグを書き換える
+// 存在しないことを期待する場合は If-None-Match: * で、そうでなければ読み込んだときのETagを If-Match に指定して書き込む
+// 使用しているライブラリが条件付きの書き込みに対応していないため、署名付きURLを作ってPUTする
+func (s *S3Storage) UploadTag(filename string, body []byte, expected string) error {
 	path := "tag/" + filename
 
-	err := s.bucket.Put(path, body, "binary/octet-stream", s3.BucketOwnerFull, s3.Options{})
+	if expected == "" {
+		err := s.bucket.Put(path, body, "binary/octet-stream", s3.BucketOwnerFull, s3.Options{})
+		if err != nil {
+			return err
+		}
+	} else {
+		current, etag, err := s.getWithETag(path)
+		if err != nil {
+			return err
+		}
+		err = checkExpectedTag(filename, current, body, expected)
+		if err != nil {
+			return err
+		}
+		if current != nil && bytes.Equal(bytes.TrimSpace(current), bytes.TrimSpace(body)) {
+			// すでに書き込まれている(リトライの前の書き込みが成功していた)
+			return nil
+		}
+
+		header := http.Header{}
+		if current == nil {
+			header.Set("If-None-Match", "*")
+		} else {
+			header.Set("If-Match", `"`+etag+`"`)
+		}
+		err = s.putConditional(path, body, header)
+		if err != nil {
+			return err
+		}
+	}
+
+	if Verbose {
+		fmt.Printf("uploading '%s'\n", path)
+	}
+	return nil
+}
+
+// putConditional は、条件のヘッダをつけてpathにbodyを書き込む
+// 条件を満たさなかった場合は、 ErrTagConflict をラップしたエラーを返す
+func (s *S3Storage) putConditional(path string, body []byte, header http.Header) error {
+	acl := http.Header{"X-Amz-Acl": []string{string(s3.BucketOwnerFull)}}
+	signedUrl := s.bucket.SignedURLWithMethod("PUT", path, time.Now().Add(15*time.Minute), nil, acl)
+
+	req, err := http.NewRequest("PUT", signedUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range acl {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	message, _ := ioutil.ReadAll(res.Body)
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return nil
+	case res.StatusCode == http.StatusPreconditionFailed, res.StatusCode == http.StatusConflict:
+		// 409 は、同時に条件付きの書き込みが行われた場合に返される
+		return errors.Wrapf(ErrTagConflict, "%s: updated while uploading", path)
+	default:
+		return &s3.Error{StatusCode: res.StatusCode, Message: fmt.Sprintf("cannot put %s, %s", path, message)}
+	}
+}
+
+// AppendTagHistory は、読み込んだときのETagを条件にして、タグの履歴に追記したものを書き込む
+// 他と同時に追記して衝突した場合は、読み込みからやり直す
+func (s *S3Storage) AppendTagHistory(filename string, line []byte) error {
+	path := "history/" + filename
+
+	for i := 0; i < appendAttempts; i++ {
+		current, etag, err := s.getWithETag(path)
+		if err != nil {
+			return err
+		}
+		if bytes.HasSuffix(current, line) {
+			// すでに追記されている(リトライの前の書き込みが成功していた)
+			return nil
+		}
+
+		header := http.Header{}
+		if current == nil {
+			header.Set("If-None-Match", "*")
+		} else {
+			header.Set("If-Match", `"`+etag+`"`)
+		}
+		err = s.putConditional(path, append(current, line...), header)
+		if IsTagConflict(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if Verbose {
+			fmt.Printf("uploading '%s'\n", path)
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrTagConflict, "%s: too many concurrent updates", path)
+}
+
+// getWithETag は、pathのオブジェクトの内容とETagを返す
+// 存在しない場合は、nilと空のETagを返す
+func (s *S3Storage) getWithETag(path string) ([]byte, string, error) {
+	res, err := s.bucket.GetResponse(path)
+	if isS3NotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, strings.Trim(res.Header.Get("ETag"), `"`), nil
+}
+
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	result := []ObjectInfo{}
+	marker := ""
+	for {
+		res, err := s.bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range res.Contents {
+			modTime, err := time.Parse(time.RFC3339, key.LastModified)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, ObjectInfo{Path: key.Key, Size: key.Size, ModTime: modTime})
+		}
+		if !res.IsTruncated || len(res.Contents) == 0 {
+			break
+		}
+		marker = res.NextMarker
+		if marker == "" {
+			marker = res.Contents[len(res.Contents)-1].Key
+		}
+	}
+	return result, nil
+}
+
+func (s *S3Storage) Delete(path string) error {
+	err := s.bucket.Del(path)
+	if isS3NotFound(err) {
+		return errors.Wrap(ErrNotFound, path)
+	}
 	if err != nil {
 		return err
 	}
 	if Verbose {
-		fmt.Printf("uploading '%s'\n", path)
+		fmt.Printf("deleting '%s'\n", path)
 	}
 	return nil
 }
+
+// isS3NotFound は、S3のエラーがオブジェクトが存在しないことによるものかどうかを返す
+func isS3NotFound(err error) bool {
+	e, ok := errors.Cause(err).(*s3.Error)
+	return ok && (e.StatusCode == 404 || e.Code == "NoSuchKey")
+}
+
+func (s *S3Storage) Get(path string) ([]byte, error) {
+	data, err := s.bucket.Get(path)
+	if isS3NotFound(err) {
+		return nil, errors.Wrap(ErrNotFound, path)
+	}
+	return data, err
+}
+
+func (s *S3Storage) Exists(path string) (bool, error) {
+	return s.bucket.Exists(path)
+}
+
+func (s *S3Storage) GetTag(filename string) ([]byte, error) {
+	return s.Get("tag/" + filename)
+}
+
+func (s *S3Storage) ListTags() ([]string, error) {
+	objects, err := s.List("tag/")
+	if err != nil {
+		return nil, err
+	}
+	return tagNamesFromObjects(objects), nil
+}
+
+func (s *S3Storage) DeleteTag(filename string) error {
+	return s.Delete("tag/" + filename)
+}
+
+func (s *S3Storage) IsRetryable(err error) bool {
+	err = errors.Cause(err)
+	if e, ok := err.(*s3.Error); ok {
+		return e.StatusCode >= 500 || e.StatusCode == 429 || e.Code == "RequestTimeout" || e.Code == "SlowDown"
+	}
+	return isTemporaryError(err)
+}
@@ -2,13 +2,97 @@ package cfs
 
 import (
 	"fmt"
+	"io"
 	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
+// ErrNotFound はストレージにオブジェクトが存在しないことを表す
+// 各ストレージはパス情報を付けてラップして返すので、 errors.Cause() で比較すること
+var ErrNotFound = errors.New("object not found")
+
+// IsNotFound は、errがオブジェクトが存在しないことによるエラーかどうかを返す
+func IsNotFound(err error) bool {
+	return errors.Cause(err) == ErrNotFound
+}
+
+// ErrTagConflict はタグが期待した内容ではなかった(他のアップロードで更新された)ことを表す
+// 各ストレージはタグの情報を付けてラップして返すので、 IsTagConflict() で比較すること
+var ErrTagConflict = errors.New("tag was updated by others")
+
+// IsTagConflict は、errがタグの内容が期待したものではなかったことによるエラーかどうかを返す
+func IsTagConflict(err error) bool {
+	return errors.Cause(err) == ErrTagConflict
+}
+
+// TagAbsent は、UploadTag の expected に指定して、タグがまだ存在しないことを期待することを表す
+const TagAbsent = "none"
+
+// checkExpectedTag は、タグの現在の内容(存在しなければnil)がexpectedと一致するかを確認する
+// expectedが空なら、常に一致するものとする
+// すでに書き込もうとしている内容(body)になっている場合は、書き込みが成功した後のリトライなので、一致するものとする
+func checkExpectedTag(filename string, current []byte, body []byte, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	actual := TagAbsent
+	if current != nil {
+		actual = strings.TrimSpace(string(current))
+	}
+	if body != nil && actual == strings.TrimSpace(string(body)) {
+		return nil
+	}
+	if actual != expected {
+		return errors.Wrapf(ErrTagConflict, "tag/%s: expected %s but %s", filename, expected, actual)
+	}
+	return nil
+}
+
+// appendAttempts は、条件付きの書き込みでタグの履歴に追記するときに、他と衝突した場合に試す回数
+const appendAttempts = 10
+
+// ObjectInfo はストレージ上の一つのオブジェクトの情報を表す
+type ObjectInfo struct {
+	Path    string // キャビネットのルートからの相対パス("data/xx/xxxx", "tag/name"など)
+	Size    int64
+	ModTime time.Time
+}
+
 type Storage interface {
 	DownloaderUrl() *url.URL
 	Upload(filename string, hash string, body []byte, overwrite bool) error
-	UploadTag(filename string, body []byte) error
+	// UploadReader は、Upload と同じだが、内容をメモリに読み込まずにrから読み込む(sizeはrのサイズ)
+	UploadReader(filename string, hash string, r io.Reader, size int64, overwrite bool) error
+	// UploadTag は、タグの内容をbodyにする
+	// expectedが空でなければ、現在のタグの内容がexpected(存在しないことを期待するなら TagAbsent)の場合だけ書き換え、
+	// そうでなければ ErrTagConflict をラップしたエラーを返す
+	UploadTag(filename string, body []byte, expected string) error
+
+	// Get は、pathのオブジェクトの内容を返す
+	Get(path string) ([]byte, error)
+	// Exists は、pathのオブジェクトが存在するかどうかを返す
+	Exists(path string) (bool, error)
+	// List は、prefixで始まるパスのオブジェクトの一覧を返す
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete は、pathのオブジェクトを削除する
+	Delete(path string) error
+
+	// GetTag は、タグの内容(バケットのハッシュ)を返す
+	GetTag(filename string) ([]byte, error)
+	// ListTags は、全てのタグの名前を返す
+	ListTags() ([]string, error)
+	// DeleteTag は、タグを削除する
+	DeleteTag(filename string) error
+	// AppendTagHistory は、タグの履歴("history/<タグ>")の末尾にlineを追記する
+	// 同時に追記しても、どちらの行も失われない
+	AppendTagHistory(filename string, line []byte) error
+
+	// IsRetryable は、ストレージの操作で返されたエラーがリトライで成功する可能性があるかどうかを返す
+	IsRetryable(err error) bool
 }
 
 func StorageFromUrl(cabinetUrl *url.URL) (Storage, error) {
@@ -39,3 +123,52 @@ func StorageFromString(cabinetUrlStr string) (Storage, error) {
 	}
 	return StorageFromUrl(cabinetUrl)
 }
+
+// LoadBucketFromStorage は、ダウンロード用のURLを経由せずに、ストレージから直接バケットを読み込む
+// locationには、タグの名前かバケットのハッシュを指定する
+func LoadBucketFromStorage(s Storage, location string) (*Bucket, error) {
+	if !isHash(location) {
+		body, err := s.GetTag(location)
+		if err != nil {
+			return nil, err
+		}
+		location = strings.TrimSpace(string(body))
+		if !isHash(location) {
+			return nil, fmt.Errorf("%s is not hash", location)
+		}
+	}
+
+	data, err := s.Get("data/" + hashPath(location))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := decodeBucket(data)
+	if err != nil {
+		return nil, err
+	}
+
+	b := NewBucket()
+	err = b.Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	b.Hash = location
+
+	return b, nil
+}
+
+// tagNamesFromObjects は、"tag/"以下のオブジェクトの一覧からタグの名前の一覧を作成する
+func tagNamesFromObjects(objects []ObjectInfo) []string {
+	names := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		names = append(names, tagNameOf(obj))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tagNameOf は、"tag/"以下のオブジェクトのタグの名前を返す
+func tagNameOf(obj ObjectInfo) string {
+	return strings.TrimPrefix(obj.Path, "tag/")
+}
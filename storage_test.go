@@ -0,0 +1,209 @@
+package cfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testStorageOperations(t *testing.T, s Storage) {
+	hash := "0123456789abcdef0123456789abcdef"
+	path := "data/" + hashPath(hash)
+
+	err := s.Upload("hoge", hash, []byte("hoge"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UploadTag("test-storage", []byte(hash), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.Get(path)
+	if err != nil || string(data) != "hoge" {
+		t.Errorf("cannot get %s, %v", path, err)
+	}
+
+	exists, err := s.Exists(path)
+	if err != nil || !exists {
+		t.Errorf("%s must exist, %v", path, err)
+	}
+
+	objects, err := s.List("data/01/")
+	if err != nil || len(objects) != 1 || objects[0].Path != path || objects[0].Size != 4 {
+		t.Errorf("invalid list %v, %v", objects, err)
+	}
+
+	tag, err := s.GetTag("test-storage")
+	if err != nil || string(tag) != hash {
+		t.Errorf("invalid tag %s, %v", tag, err)
+	}
+
+	tags, err := s.ListTags()
+	if err != nil || len(tags) != 1 || tags[0] != "test-storage" {
+		t.Errorf("invalid tags %v, %v", tags, err)
+	}
+
+	// 期待した内容でなければ、タグは書き換えられない
+	other := "fedcba9876543210fedcba9876543210"
+	err = s.UploadTag("test-storage", []byte(other), other)
+	if !IsTagConflict(err) {
+		t.Errorf("tag must not be updated from unexpected hash, but %v", err)
+	}
+	err = s.UploadTag("test-storage", []byte(other), TagAbsent)
+	if !IsTagConflict(err) {
+		t.Errorf("existing tag must not be created, but %v", err)
+	}
+	err = s.UploadTag("test-storage", []byte(other), hash)
+	if err != nil {
+		t.Errorf("tag must be updated from expected hash, but %v", err)
+	}
+	// 書き込みが成功した後のリトライは、衝突にならない
+	err = s.UploadTag("test-storage", []byte(other), hash)
+	if err != nil {
+		t.Errorf("retry of succeeded update must not be conflict, but %v", err)
+	}
+	err = s.UploadTag("test-storage-new", []byte(hash), TagAbsent)
+	if err != nil {
+		t.Errorf("new tag must be created, but %v", err)
+	}
+	s.DeleteTag("test-storage-new")
+
+	// タグの履歴は、追記される
+	s.Delete("history/test-storage")
+	for _, line := range []string{"line1\n", "line2\n"} {
+		err = s.AppendTagHistory("test-storage", []byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err = s.Get("history/test-storage")
+	if err != nil || string(data) != "line1\nline2\n" {
+		t.Errorf("tag history must be appended, but '%s' %v", data, err)
+	}
+	s.Delete("history/test-storage")
+
+	err = s.DeleteTag("test-storage")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = s.GetTag("test-storage")
+	if !IsNotFound(err) {
+		t.Errorf("deleted tag must not be found, but %v", err)
+	}
+
+	err = s.Delete(path)
+	if err != nil {
+		t.Error(err)
+	}
+	exists, err = s.Exists(path)
+	if err != nil || exists {
+		t.Errorf("%s must not exist, %v", path, err)
+	}
+	_, err = s.Get(path)
+	if !IsNotFound(err) {
+		t.Errorf("deleted object must not be found, but %v", err)
+	}
+
+	err = s.UploadReader("fuga", hash, strings.NewReader("fuga"), 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = s.Get(path)
+	if err != nil || string(data) != "fuga" {
+		t.Errorf("cannot get %s uploaded by reader, %v", path, err)
+	}
+	s.Delete(path)
+}
+
+func TestStorage(t *testing.T) {
+	testStorageOperations(t, newStorage(nil))
+}
+
+func TestDummyStorage(t *testing.T) {
+	s, err := NewDummyStorage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorageOperations(t, s)
+}
+
+func TestFileStorageTagConflict(t *testing.T) {
+	s := newStorage(nil)
+	if _, ok := s.(*FileStorage); !ok {
+		t.Skip("not file storage")
+	}
+
+	// 同じ内容を期待して同時に書き換えると、一つだけが成功する
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	succeeded := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := s.UploadTag("race", []byte(strings.Repeat(string('0'+byte(i)), 32)), TagAbsent)
+			if err == nil {
+				mutex.Lock()
+				succeeded++
+				mutex.Unlock()
+			} else if !IsTagConflict(err) {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if succeeded != 1 {
+		t.Errorf("only one update must succeed, but %d", succeeded)
+	}
+	tags, err := s.ListTags()
+	if err != nil || len(tags) != 1 {
+		t.Errorf("lock files must not be listed as tags, but %v %v", tags, err)
+	}
+}
+
+func TestFileStorageStaleLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfs-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tag-hoge.lock")
+
+	oldTimeout := lockTimeout
+	lockTimeout = 200 * time.Millisecond
+	defer func() { lockTimeout = oldTimeout }()
+
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lockFile(path)
+	if err == nil {
+		t.Errorf("locked file must not be locked again")
+	}
+
+	// 異常終了したプロセスのロックは、取り除いてロックできる
+	old := time.Now().Add(-2 * lockStaleAge)
+	err = os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock2, err := lockFile(path)
+	if err != nil {
+		t.Errorf("stale lock must be removed, but %v", err)
+	} else {
+		unlock2()
+	}
+	unlock()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 0 {
+		t.Errorf("lock files must be removed, but %v %v", files, err)
+	}
+}
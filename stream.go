@@ -0,0 +1,174 @@
+package cfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressWriter は、codecで圧縮しながらwに書き込むWriteCloserを返す
+// 圧縮を終えるには Close を呼ぶ必要がある(wはCloseされない)
+func compressWriter(codec Codec, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CodecZlib:
+		return zlib.NewWriter(w), nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	case CodecLz4:
+		return lz4.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %v", codec)
+	}
+}
+
+// canEncodeStream は、attrの属性のデータを encodeStream でエンコードできるかどうかを返す
+// AES-GCM は全体をメモリに読み込まないと暗号化できないため、ストリーミングできない
+func canEncodeStream(attr ContentAttribute) bool {
+	return !attr.AuthCrypted()
+}
+
+// encodeStream は、rの内容を圧縮/暗号化しながらwに書き込む( encodeWithKeyId のストリーミング版)
+func encodeStream(w io.Writer, r io.Reader, keyId string, attr ContentAttribute) (bool, error) {
+	if !canEncodeStream(attr) {
+		return false, fmt.Errorf("cannot encode %v data as stream", attr)
+	}
+
+	hashChanged := false
+
+	if attr.KeyTagged() {
+		_, err := w.Write(keyIdHeader(keyId))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if attr.Crypted() {
+		key, err := Option.Key(keyId)
+		if err != nil {
+			return false, err
+		}
+		block, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			return false, err
+		}
+		w = &cipher.StreamWriter{S: cipher.NewCFBEncrypter(block, []byte(Option.EncryptIv)), W: w}
+		hashChanged = true
+	}
+
+	var wc io.WriteCloser = nopWriteCloser{w}
+	if attr.Compressed() {
+		var err error
+		wc, err = compressWriter(attr.Codec(), w)
+		if err != nil {
+			return false, err
+		}
+		hashChanged = true
+	}
+
+	_, err := io.Copy(wc, r)
+	if err != nil {
+		wc.Close()
+		return false, err
+	}
+
+	return hashChanged, wc.Close()
+}
+
+// decompressReader は、codecで圧縮されたrを展開するReadCloserを返す
+func decompressReader(codec Codec, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CodecZlib:
+		return zlib.NewReader(r)
+	case CodecZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CodecLz4:
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %v", codec)
+	}
+}
+
+// readKeyId は、rの先頭の鍵IDのヘッダを読み込んで、鍵IDを返す
+func readKeyId(r io.Reader) (string, error) {
+	header := make([]byte, len(keyIdMagic)+1)
+	_, err := io.ReadFull(r, header)
+	if err != nil || !bytes.HasPrefix(header, keyIdMagic) {
+		return "", fmt.Errorf("invalid key id header")
+	}
+
+	keyId := make([]byte, int(header[len(keyIdMagic)]))
+	_, err = io.ReadFull(r, keyId)
+	if err != nil {
+		return "", fmt.Errorf("invalid key id header")
+	}
+	return string(keyId), nil
+}
+
+// decodeStream は、rのデータを復号化/展開しながらwに書き込む( decodeWithKeyring のストリーミング版)
+// AES-GCM で暗号化されたデータは、全体をメモリに読み込んで復号化する
+func decodeStream(w io.Writer, r io.Reader, attr ContentAttribute) error {
+	if !canEncodeStream(attr) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		decoded, err := decodeWithKeyring(data, attr)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(decoded)
+		return err
+	}
+
+	keyId := ""
+	if attr.KeyTagged() {
+		var err error
+		keyId, err = readKeyId(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	if attr.Crypted() {
+		key, err := Option.Key(keyId)
+		if err != nil {
+			return err
+		}
+		block, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			return err
+		}
+		r = &cipher.StreamReader{S: cipher.NewCFBDecrypter(block, []byte(Option.EncryptIv)), R: r}
+	}
+
+	if attr.Compressed() {
+		rc, err := decompressReader(attr.Codec(), r)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	}
+
+	_, err := io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,253 @@
+package cfs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProtectedTagError は、保護されたタグを強制せずに上書きしようとしたことを表す
+type ProtectedTagError struct {
+	Tag string
+}
+
+func (e *ProtectedTagError) Error() string {
+	return fmt.Sprintf("tag '%s' is protected, use --force to overwrite or remove", e.Tag)
+}
+
+// IsProtectedTag は、tagが Option.ProtectedTags のパターンにマッチするかどうかを返す
+func IsProtectedTag(tag string) bool {
+	for _, pattern := range Option.ProtectedTags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTagWritable は、tagをcurrentから書き換えてよいかどうかを確認する
+// 保護されたタグは、まだ存在しない場合か、forceが指定された場合だけ書き換えられる
+func checkTagWritable(tag string, current string, force bool) error {
+	if current != "" && !force && IsProtectedTag(tag) {
+		return &ProtectedTagError{Tag: tag}
+	}
+	return nil
+}
+
+// getTagHash は、タグが指しているバケットのハッシュを返す
+// タグが存在しない場合は、空文字列を返す
+func getTagHash(s Storage, tag string) (string, error) {
+	body, err := s.GetTag(tag)
+	if IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	hash := strings.TrimSpace(string(body))
+	if !isHash(hash) {
+		return "", fmt.Errorf("tag '%s' is not hash, '%s'", tag, hash)
+	}
+	return hash, nil
+}
+
+// SetTag は、tagがlocation(タグの名前かバケットのハッシュ)のバケットを指すようにする
+// 存在しないバケットは指定できない
+// 新しくタグが指すバケットのハッシュを返す
+func SetTag(s Storage, tag string, location string, force bool) (string, error) {
+	b, err := LoadBucketFromStorage(s, location)
+	if err != nil {
+		return "", fmt.Errorf("cannot load bucket %s, %v", location, err)
+	}
+	return b.Hash, updateTag(s, tag, b.Hash, TagActionSet, force)
+}
+
+// RollbackTag は、tagが、steps個前に指していたバケットを指すようにする
+// ロールバックで戻した先は、そこからさらに前に戻れるように、タグの履歴をたどって決める(tagStates を参照)
+// タグの履歴がない(この機能より前に作られた)タグは、 Parent をsteps個たどったバケットに戻す
+// 新しくタグが指すバケットのハッシュを返す
+func RollbackTag(s Storage, tag string, steps int, force bool) (string, error) {
+	if steps < 1 {
+		return "", fmt.Errorf("steps must be positive, but %d", steps)
+	}
+
+	history, err := LoadTagHistory(s, tag)
+	if err != nil {
+		return "", fmt.Errorf("cannot load history of %s, %v", tag, err)
+	}
+
+	var hash string
+	if len(history) > 0 {
+		states, pos := tagStates(history)
+		if steps > pos {
+			return "", fmt.Errorf("tag '%s' has only %d older buckets in its history", tag, pos)
+		}
+		hash = states[pos-steps]
+	} else {
+		hash, err = parentHash(s, tag, steps)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	b, err := LoadBucketFromStorage(s, hash)
+	if err != nil {
+		return "", fmt.Errorf("cannot load bucket %d steps before, %v", steps, err)
+	}
+	return b.Hash, updateTag(s, tag, b.Hash, TagActionRollback, force)
+}
+
+// tagStates は、タグの履歴から、タグが順に指してきたバケットのハッシュと、現在指しているものの位置を返す
+// ロールバックは、新しいハッシュを追加せずに、戻した先に位置を移すだけなので、続けてロールバックするとさらに前に戻る
+// ロールバックした後に更新すると、戻す前に指していたハッシュは捨てられる
+// タグが削除されている場合は、位置は-1になる
+func tagStates(history []TagHistoryEntry) ([]string, int) {
+	var states []string
+	pos := -1
+	push := func(hash string) {
+		if pos >= 0 && states[pos] == hash {
+			return
+		}
+		states = append(states[:pos+1], hash)
+		pos++
+	}
+
+	for _, e := range history {
+		// タグの履歴より前から存在したタグは、更新する前のハッシュから始める
+		if pos < 0 && e.Previous != "" {
+			push(e.Previous)
+		}
+
+		switch e.Action {
+		case TagActionRemove:
+			states, pos = nil, -1
+		case TagActionRollback:
+			found := false
+			for i := pos - 1; i >= 0; i-- {
+				if states[i] == e.Hash {
+					pos, found = i, true
+					break
+				}
+			}
+			if !found {
+				push(e.Hash)
+			}
+		default:
+			push(e.Hash)
+		}
+	}
+	return states, pos
+}
+
+// parentHash は、tagが指しているバケットから Parent をsteps個たどったバケットのハッシュを返す
+func parentHash(s Storage, tag string, steps int) (string, error) {
+	b, err := LoadBucketFromStorage(s, tag)
+	if err != nil {
+		return "", fmt.Errorf("cannot load bucket %s, %v", tag, err)
+	}
+	for i := 1; i < steps; i++ {
+		if b.Parent == "" {
+			return "", fmt.Errorf("tag '%s' has only %d older buckets", tag, i-1)
+		}
+		b, err = LoadBucketFromStorage(s, b.Parent)
+		if err != nil {
+			return "", fmt.Errorf("cannot load bucket %d steps before, %v", i, err)
+		}
+	}
+	if b.Parent == "" {
+		return "", fmt.Errorf("tag '%s' has only %d older buckets", tag, steps-1)
+	}
+	return b.Parent, nil
+}
+
+// updateTag は、保護されているかを確認してから、tagをhashに書き換えて、タグの履歴に記録する
+func updateTag(s Storage, tag string, hash string, action string, force bool) error {
+	current, err := getTagHash(s, tag)
+	if err != nil {
+		return err
+	}
+	err = checkTagWritable(tag, current, force)
+	if err != nil {
+		return err
+	}
+	if Verbose {
+		fmt.Printf("update tag '%s' from %s to %s\n", tag, current, hash)
+	}
+	err = s.UploadTag(tag, []byte(hash), expectedTag(current))
+	if err != nil {
+		return err
+	}
+	return appendTagHistory(s, tag, newTagHistoryEntry(action, hash, current))
+}
+
+// expectedTag は、タグが指していたバケットのハッシュ(存在しなければ空)を、UploadTag の expected の形式にする
+func expectedTag(hash string) string {
+	if hash == "" {
+		return TagAbsent
+	}
+	return hash
+}
+
+// tagBody は、タグが指していたバケットのハッシュ(存在しなければ空)を、タグの内容(存在しなければnil)にする
+func tagBody(hash string) []byte {
+	if hash == "" {
+		return nil
+	}
+	return []byte(hash)
+}
+
+// TagInfo は、一つのタグの情報を表す
+type TagInfo struct {
+	Name    string
+	Hash    string    // タグが指しているバケットのハッシュ
+	Updated time.Time // タグを更新した時刻
+	Files   int       // バケットのファイル数
+	Size    int64     // バケットのファイルの元のサイズの合計
+	Error   string    `json:",omitempty"` // バケットを読み込めなかった場合のエラー
+}
+
+// ListTagInfo は、全てのタグの情報を名前順に返す
+// タグの一覧は、 Storage.ListTags と同じく"tag/"以下のオブジェクトの一覧から作成し、更新した時刻にはオブジェクトの更新時刻を使う
+// バケットを読み込めないタグは、Error にその原因を設定して返す
+func ListTagInfo(s Storage) ([]TagInfo, error) {
+	objects, err := s.List("tag/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]TagInfo, 0, len(objects))
+	for _, obj := range objects {
+		info := TagInfo{Name: tagNameOf(obj), Updated: obj.ModTime}
+		b, err := LoadBucketFromStorage(s, info.Name)
+		if err != nil {
+			info.Error = err.Error()
+		} else {
+			info.Hash = b.Hash
+			info.Files = len(b.Contents)
+			info.Size = b.TotalSize()
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+// RemoveTag は、タグを削除して、タグの履歴に記録する
+// 保護されたタグは、forceが指定された場合だけ削除できる
+// タグが指していたバケットとファイルは、ガーベージコレクトで削除される
+func RemoveTag(s Storage, tag string, force bool) error {
+	if !force && IsProtectedTag(tag) {
+		return &ProtectedTagError{Tag: tag}
+	}
+
+	// 壊れたタグも削除できるように、指していたバケットが読み込めなくても削除する
+	current, _ := getTagHash(s, tag)
+	err := s.DeleteTag(tag)
+	if err != nil {
+		return err
+	}
+	return appendTagHistory(s, tag, newTagHistoryEntry(TagActionRemove, "", current))
+}
@@ -0,0 +1,163 @@
+package cfs
+
+import (
+	"testing"
+)
+
+func TestTagRollback(t *testing.T) {
+	c, b, dir := setupBucket()
+	b.Tag = "release"
+
+	hashes := []string{}
+	for i, content := range []string{"v1", "v2", "v3"} {
+		if i > 0 {
+			c = &Client{Bucket: b, Storage: c.Storage}
+			c.Init()
+		}
+		addFile(dir, "hoge", content)
+		c.AddFiles(dir)
+		err := c.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, b.Hash)
+	}
+	s := c.Storage
+
+	hash, err := RollbackTag(s, "release", 1, false)
+	if err != nil || hash != hashes[1] {
+		t.Errorf("tag must be rolled back to %s, but %s %v", hashes[1], hash, err)
+	}
+
+	// 続けてロールバックすると、さらに前のバケットに戻る
+	hash, err = RollbackTag(s, "release", 1, false)
+	if err != nil || hash != hashes[0] {
+		t.Errorf("tag must be rolled back again to %s, but %s %v", hashes[0], hash, err)
+	}
+	_, err = RollbackTag(s, "release", 1, false)
+	if err == nil {
+		t.Errorf("rollback beyond the tag history must be error")
+	}
+	history, err := LoadTagHistory(s, "release")
+	if err != nil || len(history) != 5 {
+		t.Fatalf("rollback must be recorded in tag history, but %v %v", history, err)
+	}
+	if e := history[4]; e.Action != TagActionRollback || e.Hash != hashes[0] || e.Previous != hashes[1] {
+		t.Errorf("invalid tag history of rollback, %v", e)
+	}
+
+	// ロールバックした後に更新すると、ロールバックする前のバケットには戻らない
+	hash, err = SetTag(s, "release", hashes[2], false)
+	if err != nil || hash != hashes[2] {
+		t.Errorf("tag must be set to %s, but %s %v", hashes[2], hash, err)
+	}
+	hash, err = RollbackTag(s, "release", 1, false)
+	if err != nil || hash != hashes[0] {
+		t.Errorf("tag must be rolled back to %s, but %s %v", hashes[0], hash, err)
+	}
+	_, err = RollbackTag(s, "release", 2, false)
+	if err == nil {
+		t.Errorf("rollback beyond the tag history must be error")
+	}
+
+	hash, err = SetTag(s, "release", hashes[2], false)
+	if err != nil || hash != hashes[2] {
+		t.Errorf("tag must be set to %s, but %s %v", hashes[2], hash, err)
+	}
+	hash, err = SetTag(s, "copy", "release", false)
+	if err != nil || hash != hashes[2] {
+		t.Errorf("tag must be set from other tag, but %s %v", hash, err)
+	}
+	_, err = SetTag(s, "release", "missing", false)
+	if err == nil {
+		t.Errorf("tag must not be set to missing bucket")
+	}
+
+	// 保護されたタグは、強制しないと書き換えられない
+	Option.ProtectedTags = []string{"rel*"}
+	defer func() { Option.ProtectedTags = nil }()
+
+	_, err = RollbackTag(s, "release", 1, false)
+	if _, ok := err.(*ProtectedTagError); !ok {
+		t.Errorf("protected tag must not be rolled back, but %v", err)
+	}
+	_, err = RollbackTag(s, "release", 1, true)
+	if err != nil {
+		t.Errorf("protected tag must be rolled back with force, but %v", err)
+	}
+
+	c = &Client{Bucket: b, Storage: s}
+	c.Init()
+	err = c.Finish()
+	if _, ok := err.(*ProtectedTagError); !ok {
+		t.Errorf("protected tag must not be uploaded, but %v", err)
+	}
+
+	// 他からタグが更新されていたら、上書きしない
+	c = &Client{Bucket: b, Storage: s, ForceTag: true, ExpectTag: hashes[1]}
+	c.Init()
+	err = c.Finish()
+	if !IsTagConflict(err) {
+		t.Errorf("tag updated by others must not be overwritten, but %v", err)
+	}
+
+	// まだ存在しないタグは、保護されていても作成できる
+	_, err = SetTag(s, "release-new", "release", false)
+	if err != nil {
+		t.Errorf("new protected tag must be created, but %v", err)
+	}
+}
+
+func TestTagList(t *testing.T) {
+	c, b, _ := setupBucketWithFiles()
+	b.Tag = "list"
+	err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := c.Storage
+
+	err = s.UploadTag("broken", []byte("not hash"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := ListTagInfo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags[0].Name != "broken" || tags[1].Name != "list" {
+		t.Fatalf("tags must be sorted by name, but %v", tags)
+	}
+	if tags[0].Error == "" {
+		t.Errorf("broken tag must have error")
+	}
+	if tags[1].Hash != b.Hash || tags[1].Files != 3 || tags[1].Size != 12 || tags[1].Updated.IsZero() {
+		t.Errorf("invalid tag info %v", tags[1])
+	}
+
+	Option.ProtectedTags = []string{"list"}
+	defer func() { Option.ProtectedTags = nil }()
+
+	err = RemoveTag(s, "list", false)
+	if _, ok := err.(*ProtectedTagError); !ok {
+		t.Errorf("protected tag must not be removed, but %v", err)
+	}
+	err = RemoveTag(s, "list", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := LoadTagHistory(s, "list")
+	if err != nil || len(history) != 2 || history[1].Action != TagActionRemove || history[1].Previous != b.Hash {
+		t.Errorf("removing tag must be recorded in tag history, but %v %v", history, err)
+	}
+	err = RemoveTag(s, "list", true)
+	if !IsNotFound(err) {
+		t.Errorf("removing missing tag must be not found, but %v", err)
+	}
+
+	tags, err = ListTagInfo(s)
+	if err != nil || len(tags) != 1 {
+		t.Errorf("tag must be removed, but %v %v", tags, err)
+	}
+}
@@ -1,11 +1,13 @@
 package cfs
 
 import (
-	"bytes"
-	"compress/zlib"
 	"crypto/aes"
 	"crypto/cipher"
-	"io"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
 	"os"
 )
 
@@ -13,8 +15,38 @@ func isWindows() bool {
 	return os.PathSeparator == '\\' && os.PathListSeparator == ';'
 }
 
+// ハッシュの種類
+const (
+	HashTypeMD5    = "md5"    // 古いバケットのハッシュ(32文字)
+	HashTypeSHA256 = "sha256" // SHA-256(64文字)
+)
+
+// NewHash は、hashTypeのハッシュ関数を返す
+func NewHash(hashType string) (hash.Hash, error) {
+	switch hashType {
+	case HashTypeMD5:
+		return md5.New(), nil
+	case HashTypeSHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("invalid hash type '%s'", hashType)
+	}
+}
+
+// HashTypeOf は、ハッシュの文字列の長さからハッシュの種類を返す
+// ハッシュでない場合は空文字列を返す
+func HashTypeOf(hash string) string {
+	if !isHash(hash) {
+		return ""
+	}
+	if len(hash) == sha256.Size*2 {
+		return HashTypeSHA256
+	}
+	return HashTypeMD5
+}
+
 func isHash(str string) bool {
-	if len(str) != 32 {
+	if len(str) != md5.Size*2 && len(str) != sha256.Size*2 {
 		return false
 	}
 	for _, c := range str {
@@ -25,6 +57,22 @@ func isHash(str string) bool {
 	return true
 }
 
+// sumLike は、hashと同じ種類のハッシュ関数でdataのハッシュを計算する
+func sumLike(hash string, data []byte) string {
+	h := newHashLike(hash)
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// newHashLike は、hashと同じ種類のハッシュ関数を返す
+// ハッシュでない場合は、md5を返す
+func newHashLike(hash string) hash.Hash {
+	if HashTypeOf(hash) == HashTypeSHA256 {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
 func hashPath(hash string) string {
 	if !isHash(hash) {
 		panic("invalid hash " + hash)
@@ -37,20 +85,27 @@ func encode(origData []byte, encrypt_key string, encrypt_iv string, attr Content
 	hash_changed := false
 
 	if attr.Compressed() {
-		var buf bytes.Buffer
-		w := zlib.NewWriter(&buf)
-		w.Write(origData)
-		w.Close()
-		data = buf.Bytes()
+		compressed, err := compress(attr.Codec(), origData)
+		if err != nil {
+			return nil, false, err
+		}
+		data = compressed
 		hash_changed = true
 	}
 
-	if attr.Crypted() {
-		block, err := aes.NewCipher([]byte(Option.EncryptKey))
+	if attr.AuthCrypted() {
+		cipher_data, err := sealGCM(encrypt_key, data)
+		if err != nil {
+			return nil, false, err
+		}
+		data = cipher_data
+		hash_changed = true
+	} else if attr.Crypted() {
+		block, err := aes.NewCipher([]byte(encrypt_key))
 		if err != nil {
 			return nil, false, err
 		}
-		cfb := cipher.NewCFBEncrypter(block, []byte(Option.EncryptIv))
+		cfb := cipher.NewCFBEncrypter(block, []byte(encrypt_iv))
 		cipher_data := make([]byte, len(data))
 		cfb.XORKeyStream(cipher_data, data)
 		data = cipher_data
@@ -62,7 +117,13 @@ func encode(origData []byte, encrypt_key string, encrypt_iv string, attr Content
 
 func decode(data []byte, encrypt_key string, encrypt_iv string, attr ContentAttribute) ([]byte, error) {
 
-	if attr.Crypted() {
+	if attr.AuthCrypted() {
+		plain_data, err := openGCM(encrypt_key, data)
+		if err != nil {
+			return nil, err
+		}
+		data = plain_data
+	} else if attr.Crypted() {
 		block, err := aes.NewCipher([]byte(encrypt_key))
 		if err != nil {
 			return nil, err
@@ -74,20 +135,69 @@ func decode(data []byte, encrypt_key string, encrypt_iv string, attr ContentAttr
 	}
 
 	if attr.Compressed() {
-		r, err := zlib.NewReader(bytes.NewReader(data))
+		decompressed, err := decompress(attr.Codec(), data)
 		if err != nil {
 			return nil, err
 		}
+		data = decompressed
+	}
 
-		buf := bytes.NewBuffer(nil)
-		_, err = io.Copy(buf, r)
-		if err != nil {
-			return nil, err
-		}
+	return data, nil
+}
 
-		r.Close()
-		data = buf.Bytes()
+// sealGCM は、dataをAES-GCMで暗号化して、先頭にnonceをつけて返す
+// nonceは鍵と内容のHMACから作るので、同じ内容なら同じ暗号文(=同じハッシュ)になり、重複排除が働く
+// 暗号化とnonceの作成には、鍵から導出した別々の鍵を使う
+func sealGCM(encrypt_key string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(encrypt_key)
+	if err != nil {
+		return nil, err
 	}
 
-	return data, nil
+	mac := hmac.New(sha256.New, gcmSubkey(encrypt_key, "cfs-gcm-nonce"))
+	mac.Write(data)
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	copy(nonce, mac.Sum(nil))
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// openGCM は、sealGCM で暗号化されたデータを復号化する
+// データが改竄されていた場合はエラーを返す
+func openGCM(encrypt_key string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(encrypt_key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("too short encrypted data, %d bytes", len(data))
+	}
+
+	nonce := data[:gcm.NonceSize()]
+	plain_data, err := gcm.Open(nil, nonce, data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt data, %v", err)
+	}
+	return plain_data, nil
+}
+
+// newGCM は、鍵から導出した暗号化用の鍵で、AES-GCMを作成する
+// 導出した鍵は、元の鍵と同じ長さ(=同じAESの鍵長)にする
+func newGCM(encrypt_key string) (cipher.AEAD, error) {
+	if _, err := aes.NewCipher([]byte(encrypt_key)); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(gcmSubkey(encrypt_key, "cfs-gcm-enc")[:len(encrypt_key)])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmSubkey は、鍵とラベルのHMACで、用途ごとの鍵を導出する
+func gcmSubkey(encrypt_key string, label string) []byte {
+	mac := hmac.New(sha256.New, []byte(encrypt_key))
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
 }
@@ -0,0 +1,157 @@
+package cfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	key := "12345678901234567890123456789012"
+	iv := "1234567890123456"
+	origData := []byte("hogehogehogehogehogehoge")
+
+	attrs := []ContentAttribute{
+		NoContentAttribute,
+		Compressed,
+		Crypted,
+		Compressed | Crypted,
+		AuthCrypted,
+		Compressed | AuthCrypted,
+		ContentAttribute(Compressed).WithCodec(CodecZstd),
+		ContentAttribute(Compressed | Crypted).WithCodec(CodecZstd),
+		ContentAttribute(Compressed).WithCodec(CodecLz4),
+		ContentAttribute(Compressed | AuthCrypted).WithCodec(CodecLz4),
+	}
+
+	for _, attr := range attrs {
+		data, _, err := encode(origData, key, iv, attr)
+		if err != nil {
+			t.Errorf("cannot encode with attr %d, %v", attr, err)
+			continue
+		}
+
+		decoded, err := decode(data, key, iv, attr)
+		if err != nil {
+			t.Errorf("cannot decode with attr %d, %v", attr, err)
+			continue
+		}
+		if !bytes.Equal(decoded, origData) {
+			t.Errorf("decoded data with attr %d must be same as original", attr)
+		}
+	}
+}
+
+func TestAuthCrypted(t *testing.T) {
+	key := "12345678901234567890123456789012"
+	origData := []byte("hoge")
+
+	data, _, err := encode(origData, key, "", AuthCrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じ内容なら同じ暗号文になる
+	data2, _, err := encode(origData, key, "", AuthCrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Errorf("same data must be encrypted to same data")
+	}
+
+	// 違う内容なら違うnonceになる
+	data3, _, err := encode([]byte("fuga"), key, "", AuthCrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data[:12], data3[:12]) {
+		t.Errorf("nonce must be different for different data")
+	}
+
+	// 改竄されたデータは復号化できない
+	data[len(data)-1] ^= 1
+	_, err = decode(data, key, "", AuthCrypted)
+	if err == nil {
+		t.Errorf("tampered data must not be decrypted")
+	}
+}
+
+func TestCodec(t *testing.T) {
+	origData := bytes.Repeat([]byte("hoge"), 100)
+
+	for _, codec := range []Codec{CodecZlib, CodecZstd, CodecLz4} {
+		data, err := compress(codec, origData)
+		if err != nil {
+			t.Errorf("cannot compress with %v, %v", codec, err)
+			continue
+		}
+		if len(data) >= len(origData) {
+			t.Errorf("%v must compress data", codec)
+		}
+		if detectCodec(data) != codec {
+			t.Errorf("codec must be detected as %v but %v", codec, detectCodec(data))
+		}
+	}
+
+	attr := ContentAttribute(Compressed | Crypted).WithCodec(CodecLz4)
+	if attr.Codec() != CodecLz4 || !attr.Compressed() || !attr.Crypted() {
+		t.Errorf("invalid attr %d", attr)
+	}
+	if ContentAttribute(Compressed).Codec() != CodecZlib {
+		t.Errorf("old compressed content must be zlib")
+	}
+
+	codec, err := ParseCodec("zstd")
+	if err != nil || codec != CodecZstd {
+		t.Errorf("cannot parse zstd")
+	}
+	_, err = ParseCodec("unknown")
+	if err == nil {
+		t.Errorf("unknown codec must be error")
+	}
+}
+
+func TestEncodeDecodeStream(t *testing.T) {
+	defer setupKeyring(t)()
+	origData := bytes.Repeat([]byte("hogehogehoge"), 1000)
+
+	attrs := []ContentAttribute{
+		NoContentAttribute,
+		Compressed,
+		ContentAttribute(Compressed).WithCodec(CodecZstd),
+		ContentAttribute(Compressed).WithCodec(CodecLz4),
+		Crypted,
+		Compressed | Crypted | KeyTagged,
+		Compressed | AuthCrypted | KeyTagged,
+	}
+	for _, attr := range attrs {
+		keyId := ""
+		if attr.KeyTagged() {
+			keyId = "new"
+		}
+
+		// ストリーミングでエンコードしたデータは、メモリ上でデコードできる
+		var encoded bytes.Buffer
+		if canEncodeStream(attr) {
+			_, err := encodeStream(&encoded, bytes.NewReader(origData), keyId, attr)
+			if err != nil {
+				t.Fatalf("cannot encode stream with %v, %v", attr, err)
+			}
+			decoded, err := decodeWithKeyring(encoded.Bytes(), attr)
+			if err != nil || !bytes.Equal(decoded, origData) {
+				t.Errorf("cannot decode stream encoded data with %v, %v", attr, err)
+			}
+		}
+
+		// メモリ上でエンコードしたデータは、ストリーミングでデコードできる
+		data, _, err := encodeWithKeyId(origData, keyId, attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded bytes.Buffer
+		err = decodeStream(&decoded, bytes.NewReader(data), attr)
+		if err != nil || !bytes.Equal(decoded.Bytes(), origData) {
+			t.Errorf("cannot decode stream with %v, %v", attr, err)
+		}
+	}
+}